@@ -0,0 +1,38 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import "go.uber.org/zap"
+
+// Reasons recorded in audit log entries for denied connection requests.
+const (
+	auditReasonTokenRevoked              = "token_revoked"
+	auditReasonTenantSuspended           = "tenant_suspended"
+	auditReasonMissingMsClaim            = "missing_ms_claim"
+	auditReasonNoMatchingRule            = "no_matching_rule"
+	auditReasonDeniedByRule              = "denied_by_rule"
+	auditReasonConditionNotMet           = "condition_not_met"
+	auditReasonDeniedByPdp               = "denied_by_pdp"
+	auditReasonPdpUnavailable            = "pdp_unavailable"
+	auditReasonDeviceUnknown             = "device_unknown"
+	auditReasonDeviceLocked              = "device_locked"
+	auditReasonDeviceWrongTenant         = "device_wrong_tenant"
+	auditReasonDeviceRegistryUnavailable = "device_registry_unavailable"
+	auditReasonListUnavailable           = "list_unavailable"
+)
+
+// auditDenied records an audit log entry for a connection request that was
+// denied for the specified reason.
+func auditDenied(reason string, claims *DstsTokenClaims, fields ...zap.Field) {
+	fields = append([]zap.Field{
+		zap.String("Audit reason:", reason),
+		zap.String("Issuer:", claims.Issuer),
+		zap.String("Subject:", claims.Subject),
+		zap.String("Token ID:", claims.ID),
+		zap.String("Token type:", claims.TokenType),
+		zap.String("Tenant ID:", claims.TenantID),
+	}, fields...)
+	iotLogger.Warn("AUDIT: Connection request denied!", fields...)
+}
@@ -0,0 +1,296 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// JSON array describing the trusted token issuers, specified either inline
+	// or in a file. Issuer names are matched exactly against the 'iss' claim.
+	// If not specified, the DSTS issuer is trusted with the JWKS endpoint
+	// specified by DSTS_JWKS_URL.
+	ENV_DSTS_TRUSTED_ISSUERS      = "DSTS_TRUSTED_ISSUERS"
+	ENV_DSTS_TRUSTED_ISSUERS_FILE = "DSTS_TRUSTED_ISSUERS_FILE"
+
+	// Base URL of the DSTS issuer. If specified instead of DSTS_JWKS_URL, the
+	// JWKS endpoint is resolved using OpenID Connect discovery.
+	ENV_DSTS_ISSUER_URL = "DSTS_ISSUER_URL"
+
+	// Interval after which the OpenID provider configuration of issuers is
+	// rediscovered.
+	ENV_OIDC_DISCOVERY_INTERVAL = "OIDC_DISCOVERY_INTERVAL"
+
+	// Number of attempts made to retrieve the JWKS or the OpenID provider
+	// configuration from an issuer.
+	ENV_JWKS_FETCH_MAX_ATTEMPTS = "JWKS_FETCH_MAX_ATTEMPTS"
+
+	// Deadline for refetches of the JWKS triggered by tokens presenting an
+	// unknown kid, including retries. Connection requests wait for these.
+	ENV_JWKS_FETCH_DEADLINE = "JWKS_FETCH_DEADLINE"
+
+	// Deadline for all requests made to issuers and list endpoints while the
+	// lambda starts, including retries.
+	ENV_STARTUP_FETCH_DEADLINE = "STARTUP_FETCH_DEADLINE"
+
+	// Transport settings for connections to the DSTS. See httpClientConfig.
+	ENV_JWKS_CA_BUNDLE_FILE   = "JWKS_CA_BUNDLE_FILE"
+	ENV_JWKS_CLIENT_CERT_FILE = "JWKS_CLIENT_CERT_FILE"
+	ENV_JWKS_CLIENT_KEY_FILE  = "JWKS_CLIENT_KEY_FILE"
+	ENV_JWKS_PROXY_URL        = "JWKS_PROXY_URL"
+	ENV_JWKS_HTTP_TIMEOUT     = "JWKS_HTTP_TIMEOUT"
+	ENV_JWKS_TLS_MIN_VERSION  = "JWKS_TLS_MIN_VERSION"
+
+	// Maximum age of the JWKS persisted to /tmp, or of the JWKS snapshot
+	// file, that may be used when an issuer's JWKS endpoint is unreachable at
+	// startup.
+	ENV_JWKS_SNAPSHOT_MAX_STALENESS = "JWKS_SNAPSHOT_MAX_STALENESS"
+
+	// Path to a file containing JWKS snapshots used when an issuer's JWKS
+	// endpoint is unreachable at startup.
+	ENV_JWKS_SNAPSHOT_FILE = "JWKS_SNAPSHOT_FILE"
+
+	// Path to a PEM file containing the root CAs that must certify the JWKS
+	// signing keys of issuers. If specified, keys without a valid certificate
+	// chain (x5c) are rejected.
+	ENV_JWKS_X5C_ROOT_CA_FILE = "JWKS_X5C_ROOT_CA_FILE"
+
+	// Interval after which the JWKS signing keys are refreshed, specified as
+	// a Go duration string (eg: 30m). Caching directives returned by the DSTS
+	// take precedence over this setting.
+	ENV_JWKS_REFRESH_INTERVAL = "JWKS_REFRESH_INTERVAL"
+
+	// Minimum interval between refetches of the JWKS triggered by tokens
+	// presenting an unknown kid.
+	ENV_JWKS_MIN_REFETCH_INTERVAL = "JWKS_MIN_REFETCH_INTERVAL"
+
+	// Duration for which a kid that was not found in the JWKS is remembered
+	// and rejected without refetching the JWKS.
+	ENV_JWKS_UNKNOWN_KID_CACHE_TTL = "JWKS_UNKNOWN_KID_CACHE_TTL"
+
+	// Comma separated list of signing algorithms accepted for access tokens.
+	ENV_ALLOWED_SIGNING_ALGORITHMS = "ALLOWED_SIGNING_ALGORITHMS"
+
+	// Location of the denylist of revoked token IDs ('jti' claim), specified as
+	// either a file path or an HTTP URL, and the interval after which it is
+	// refreshed.
+	ENV_REVOCATION_LIST_FILE             = "REVOCATION_LIST_FILE"
+	ENV_REVOCATION_LIST_URL              = "REVOCATION_LIST_URL"
+	ENV_REVOCATION_LIST_REFRESH_INTERVAL = "REVOCATION_LIST_REFRESH_INTERVAL"
+
+	// Location of the list of IDs of quarantined devices, specified as either a
+	// file path or an HTTP URL, and the interval after which it is refreshed.
+	ENV_QUARANTINE_LIST_FILE             = "QUARANTINE_LIST_FILE"
+	ENV_QUARANTINE_LIST_URL              = "QUARANTINE_LIST_URL"
+	ENV_QUARANTINE_LIST_REFRESH_INTERVAL = "QUARANTINE_LIST_REFRESH_INTERVAL"
+
+	// Location of the list of IDs of suspended tenants, specified as either a
+	// file path or an HTTP URL, and the interval after which it is refreshed.
+	ENV_SUSPENDED_TENANTS_FILE             = "SUSPENDED_TENANTS_FILE"
+	ENV_SUSPENDED_TENANTS_URL              = "SUSPENDED_TENANTS_URL"
+	ENV_SUSPENDED_TENANTS_REFRESH_INTERVAL = "SUSPENDED_TENANTS_REFRESH_INTERVAL"
+
+	// Whether requests are allowed ('fail_open', default) or denied
+	// ('fail_closed') while the token revocation, quarantine or suspended
+	// tenant list has not been loaded successfully since the lambda started.
+	ENV_LIST_FAILURE_MODE = "LIST_FAILURE_MODE"
+
+	// Topic scheme used in the policies issued to devices: 'v1' (default), 'v2'
+	// for tenant scoped topics, or 'both' while migrating from v1 to v2.
+	ENV_DEVICE_TOPIC_SCHEME = "DEVICE_TOPIC_SCHEME"
+
+	// Handling of device access tokens that don't specify the management
+	// service ('ms' claim) of the device: 'deny' to deny the connection
+	// request, 'no_broadcast' (default) to allow the device to connect
+	// without access to broadcast messages or cloud topics, or
+	// 'legacy_publish' to also allow it to publish to the shared cloud topics.
+	ENV_MISSING_MS_CLAIM_BEHAVIOR = "MISSING_MS_CLAIM_BEHAVIOR"
+
+	// Path to a JSON or YAML file containing policy templates that override or
+	// add to the built-in device and scheduler policies.
+	ENV_POLICY_TEMPLATES_FILE = "POLICY_TEMPLATES_FILE"
+
+	// Path to a JSON or YAML file containing the ordered list of authorization
+	// rules that select the policy issued to clients. Replaces the built-in
+	// rules.
+	ENV_AUTHORIZATION_RULES_FILE = "AUTHORIZATION_RULES_FILE"
+
+	// URL of an external policy decision point consulted for connection
+	// requests allowed by the authorization rules, the timeout for requests
+	// to it, whether requests are allowed ('fail_open') or denied
+	// ('fail_closed', default) when it is unavailable, and the duration for
+	// which its decisions are cached.
+	ENV_PDP_URL          = "PDP_URL"
+	ENV_PDP_TIMEOUT      = "PDP_TIMEOUT"
+	ENV_PDP_FAILURE_MODE = "PDP_FAILURE_MODE"
+	ENV_PDP_CACHE_TTL    = "PDP_CACHE_TTL"
+
+	// Location of the registry of enrolled devices consulted when devices
+	// connect, specified as either a JSON, YAML or CSV file path or an HTTP
+	// URL. Devices looked up at the URL are cached, up to the specified number
+	// of devices and for the specified duration.
+	ENV_DEVICE_REGISTRY_FILE       = "DEVICE_REGISTRY_FILE"
+	ENV_DEVICE_REGISTRY_URL        = "DEVICE_REGISTRY_URL"
+	ENV_DEVICE_REGISTRY_TIMEOUT    = "DEVICE_REGISTRY_TIMEOUT"
+	ENV_DEVICE_REGISTRY_CACHE_SIZE = "DEVICE_REGISTRY_CACHE_SIZE"
+	ENV_DEVICE_REGISTRY_CACHE_TTL  = "DEVICE_REGISTRY_CACHE_TTL"
+
+	// Comma separated lists of audiences expected in device and app access
+	// tokens respectively. Tokens must contain at least one of the expected
+	// audiences in their 'aud' claim. Both are required.
+	ENV_DEVICE_TOKEN_AUDIENCES = "DEVICE_TOKEN_AUDIENCES"
+	ENV_APP_TOKEN_AUDIENCES    = "APP_TOKEN_AUDIENCES"
+)
+
+// getJwksKeyStoreSettings returns the settings for JWKS key stores.
+func getJwksKeyStoreSettings() (jwksKeyStoreSettings, error) {
+	var x5cRoots *x509.CertPool
+	if x5cRootCaFile := os.Getenv(ENV_JWKS_X5C_ROOT_CA_FILE); x5cRootCaFile != "" {
+		var err error
+		x5cRoots, err = loadCertPool(x5cRootCaFile)
+		if err != nil {
+			return jwksKeyStoreSettings{}, err
+		}
+	}
+
+	return jwksKeyStoreSettings{
+		refreshInterval: getEnvDuration(ENV_JWKS_REFRESH_INTERVAL,
+			defaultJwksRefreshInterval),
+		minRefetchInterval: getEnvDuration(ENV_JWKS_MIN_REFETCH_INTERVAL,
+			defaultJwksMinRefetchInterval),
+		unknownKidCacheTTL: getEnvDuration(ENV_JWKS_UNKNOWN_KID_CACHE_TTL,
+			defaultJwksUnknownKidCacheTTL),
+		fetchDeadline: getEnvDuration(ENV_JWKS_FETCH_DEADLINE,
+			defaultJwksFetchDeadline),
+		x5cRoots: x5cRoots,
+	}, nil
+}
+
+// getHttpClientConfig returns the transport settings for connections to the
+// DSTS.
+func getHttpClientConfig() httpClientConfig {
+	tlsMinVersion := os.Getenv(ENV_JWKS_TLS_MIN_VERSION)
+	if tlsMinVersion == "" {
+		tlsMinVersion = defaultTLSMinVersion
+	}
+
+	return httpClientConfig{
+		caBundleFile:   os.Getenv(ENV_JWKS_CA_BUNDLE_FILE),
+		clientCertFile: os.Getenv(ENV_JWKS_CLIENT_CERT_FILE),
+		clientKeyFile:  os.Getenv(ENV_JWKS_CLIENT_KEY_FILE),
+		proxyUrl:       os.Getenv(ENV_JWKS_PROXY_URL),
+		requestTimeout: getEnvDuration(ENV_JWKS_HTTP_TIMEOUT,
+			defaultHttpRequestTimeout),
+		tlsMinVersion: tlsMinVersion,
+	}
+}
+
+// getEnvDuration parses the duration specified in the environment variable.
+// If the variable is not set or contains an invalid value, the specified
+// default value is returned.
+func getEnvDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		iotLogger.Error("Invalid duration specified in environment variable. Using default value!",
+			zap.String("Variable:", name),
+			zap.String("Value:", value),
+			zap.Duration("Default value:", defaultValue),
+		)
+		return defaultValue
+	}
+	return duration
+}
+
+// getEnvInt parses the positive integer specified in the environment variable.
+// If the variable is not set or contains an invalid value, the specified
+// default value is returned.
+func getEnvInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsedValue, err := strconv.Atoi(value)
+	if err != nil || parsedValue <= 0 {
+		iotLogger.Error("Invalid integer specified in environment variable. Using default value!",
+			zap.String("Variable:", name),
+			zap.String("Value:", value),
+			zap.Int("Default value:", defaultValue),
+		)
+		return defaultValue
+	}
+	return parsedValue
+}
+
+// getEnvString returns the value of the environment variable, or the specified
+// default value if the variable is not set.
+func getEnvString(name string, defaultValue string) string {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvList parses the comma separated list of values specified in the
+// environment variable. Empty values are ignored. If the variable is not set,
+// the specified default value is returned.
+func getEnvList(name string, defaultValue []string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// loadConfigFile loads the JSON or YAML configuration file into the specified
+// value. Files with the .json extension are parsed as JSON and other files as
+// YAML. Unknown fields are rejected, so that typos are not silently ignored.
+func loadConfigFile(path string, v interface{}) error {
+	configBytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(configBytes))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(v)
+	}
+
+	return decodeYamlConfig(configBytes, v)
+}
+
+// decodeYamlConfig decodes the YAML configuration into the specified value,
+// rejecting unknown fields.
+func decodeYamlConfig(configBytes []byte, v interface{}) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(configBytes))
+	decoder.KnownFields(true)
+	return decoder.Decode(v)
+}
@@ -7,93 +7,111 @@ package main
 import (
 	"fmt"
 
-	"github.com/aws/aws-lambda-go/events"
+	"go.uber.org/zap"
 )
 
+// Topic levels under @cloud that are used by other topics, and therefore
+// cannot be used as the name of a management service.
+var reservedCloudTopicLevels = []string{"task_responses", "quarantine"}
+
+// Topic schemes used in the policies issued to devices.
 const (
-	// ARN of the client allowed to connect to the hub.
-	clientResourceFormat = "arn:aws:iot:%s:%s:client/%s"
-
-	//////////////////// Subscribe topics /////////////////////////////////////
-	//                Topics devices need to subscribe to.
-	// - topic on which tasks intended for the device to execute are published.
-	// arn:aws:iot:AWS_REGION:AWS_ACCOUNT_ID:topicfilter/v1/DEVICE_ID/tasks
-	// arn:aws:iot:us-west-2:11111122222:topicfilter/v1/d4a8cd9a-be0e-4e71-b1b5-91d0226dad0d/tasks
-	deviceTasksTopicSubscribeFormat = "arn:aws:iot:%s:%s:topicfilter/v1/%s/tasks"
-
-	// arn:aws:iot:AWS_REGION:AWS_ACCOUNT_ID:topic/v1/DEVICE_ID/tasks
-	// arn:aws:iot:us-west-2:11111122222:topic/v1/d4a8cd9a-be0e-4e71-b1b5-91d0226dad0d/tasks
-	deviceTasksTopicReceiveFormat = "arn:aws:iot:%s:%s:topic/v1/%s/tasks"
-
-	// - topic on which the management service broadcasts messages intended for
-	// all devices managed by it.
-	// arn:aws:iot:AWS_REGION:AWS_ACCOUNT_ID:topicfilter/v1/@devices/MANAGEMENT_SERVICE
-	// arn:aws:iot:us-west-2:11111122222:topicfilter/v1/@devices/hpcem
-	deviceServiceBroadcastTopicSubscribeFormat = "arn:aws:iot:%s:%s:topicfilter/v1/@devices/+"
-
-	// arn:aws:iot:AWS_REGION:AWS_ACCOUNT_ID:topic/v1/@devices/MANAGEMENT_SERVICE
-	// arn:aws:iot:us-west-2:11111122222:topic/v1/@devices/hpcem
-	deviceServiceBroadcastTopicReceiveFormat = "arn:aws:iot:%s:%s:topic/v1/@devices/+"
-	///////////////////////////////////////////////////////////////////////////
-
-	//////////////////// Publish topics ///////////////////////////////////////
-	//                Topics to which devices publish messages.
-	// - topic to which devices publish task responses.
-	// arn:aws:iot:AWS_REGION:AWS_ACCOUNT_ID:topic/v1/@cloud/task_responses
-	// arn:aws:iot:us-west-2:11111122222:topic/v1/@cloud/task_responses
-	cloudTaskResponsesTopic = "arn:aws:iot:%s:%s:topic/v1/@cloud/task_responses"
-
-	// - topic to which devices publish messages intended for their
-	// device managment service.
-	// arn:aws:iot:AWS_REGION:AWS_ACCOUNT_ID:topic/v1/@cloud
-	// arn:aws:iot:us-west-2:11111122222:topic/v1/@cloud
-	cloudServiceMessageTopic = "arn:aws:iot:%s:%s:topic/v1/@cloud"
-	///////////////////////////////////////////////////////////////////////////
+	// v1 topics, eg: v1/DEVICE_ID/tasks.
+	topicSchemeV1 = "v1"
+
+	// Tenant scoped v2 topics, eg: v2/TENANT_ID/DEVICE_ID/tasks.
+	topicSchemeV2 = "v2"
+
+	// Both v1 and v2 topics, used while migrating from v1 to v2.
+	topicSchemeBoth = "both"
 )
 
-var (
-	// AWS IoT Core policy actions.
-	connectAction   = []string{"iot:Connect"}
-	publishAction   = []string{"iot:Publish"}
-	receiveAction   = []string{"iot:Receive"}
-	subscribeAction = []string{"iot:Subscribe"}
+// Topic scheme used in the policies issued to devices.
+var deviceTopicScheme = topicSchemeV1
+
+// Handling of device access tokens that don't specify the management service
+// ('ms' claim) of the device.
+const (
+	// Deny the connection request.
+	missingMsClaimDeny = "deny"
+
+	// Allow the device to connect, without access to broadcast messages and
+	// without publishing to any cloud topic.
+	missingMsClaimNoBroadcast = "no_broadcast"
+
+	// Allow the device to connect without access to broadcast messages, and
+	// to publish to the shared cloud topics that were used before management
+	// service scoped topics were introduced. Any device allowed to connect
+	// this way can inject messages into the stream of every management
+	// service, so this is only intended for migrating older devices.
+	missingMsClaimLegacyPublish = "legacy_publish"
 )
 
-func createIotPolicyDocumentForDevice(awsRegion string, awsAccount string,
-	deviceID string) []*events.IAMPolicyDocument {
-	policyDoc := events.IAMPolicyDocument{
-		Version: "2012-10-17",
-		Statement: []events.IAMPolicyStatement{
-			{
-				Action: connectAction,
-				Effect: "Allow",
-				Resource: []string{fmt.Sprintf(clientResourceFormat, awsRegion,
-					awsAccount, deviceID)},
-			},
-			{
-				Action: subscribeAction,
-				Effect: "Allow",
-				Resource: []string{
-					fmt.Sprintf(deviceTasksTopicSubscribeFormat, awsRegion, awsAccount, deviceID),
-					fmt.Sprintf(deviceServiceBroadcastTopicSubscribeFormat, awsRegion,
-						awsAccount)},
-			},
-			{
-				Action: receiveAction,
-				Effect: "Allow",
-				Resource: []string{
-					fmt.Sprintf(deviceTasksTopicReceiveFormat, awsRegion, awsAccount, deviceID),
-					fmt.Sprintf(deviceServiceBroadcastTopicReceiveFormat, awsRegion,
-						awsAccount)},
-			},
-			{
-				Action: publishAction,
-				Effect: "Allow",
-				Resource: []string{
-					fmt.Sprintf(cloudTaskResponsesTopic, awsRegion, awsAccount),
-					fmt.Sprintf(cloudServiceMessageTopic, awsRegion, awsAccount)},
-			},
-		},
+// Handling of device access tokens that don't specify the management service
+// of the device.
+var missingMsClaimBehavior = missingMsClaimNoBroadcast
+
+// parseTopicScheme validates the specified device topic scheme.
+func parseTopicScheme(scheme string) (string, error) {
+	switch scheme {
+	case topicSchemeV1, topicSchemeV2, topicSchemeBoth:
+		return scheme, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrInvalidTopicScheme, scheme)
+}
+
+// parseMissingMsClaimBehavior validates the specified handling of device
+// access tokens that don't specify the management service of the device.
+func parseMissingMsClaimBehavior(behavior string) (string, error) {
+	switch behavior {
+	case missingMsClaimDeny, missingMsClaimNoBroadcast,
+		missingMsClaimLegacyPublish:
+		return behavior, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrInvalidMissingMsClaimBehavior, behavior)
+}
+
+// selectDeviceTemplate selects the template of the policy issued to the
+// device to which the device access token was issued, using the configured
+// topic scheme and handling of tokens without a management service.
+func selectDeviceTemplate(req *policyRequest) (string, error) {
+	claims := req.claims
+	deviceID := claims.Subject
+
+	// Devices may only receive broadcast messages from, and publish messages
+	// to, the management service that manages them.
+	managementService := claims.ManagementService
+	if managementService == "" {
+		if missingMsClaimBehavior == missingMsClaimDeny {
+			auditDenied(auditReasonMissingMsClaim, claims)
+			return "", ErrMissingMsClaim
+		}
+		iotLogger.Warn("Device access token has no management service. Broadcast messages will not be received, and messages may only be published to shared cloud topics if allowed!",
+			zap.String("Device ID:", deviceID),
+		)
+	} else if !isValidTopicLevel(managementService) ||
+		containsString(reservedCloudTopicLevels, managementService) {
+		return "", fmt.Errorf("%w: ms: %q", ErrInvalidTopicClaim,
+			managementService)
+	}
+
+	template := policyTemplateDevice + "_" + deviceTopicSchemeFor(claims)
+	if managementService == "" {
+		template += "_" + missingMsClaimBehavior
+	}
+	return template, nil
+}
+
+// deviceTopicSchemeFor returns the topic scheme used in the policy issued to
+// the device to which the device access token was issued. Topics in the v2
+// scheme are scoped to the tenant of the device. While migrating from v1,
+// devices whose tokens don't have a tenant ID are only issued v1 topics.
+func deviceTopicSchemeFor(claims *DstsTokenClaims) string {
+	if deviceTopicScheme == topicSchemeBoth && claims.TenantID == "" {
+		iotLogger.Warn("Device access token has no tenant ID. Issuing only v1 topics!",
+			zap.String("Device ID:", claims.Subject),
+		)
+		return topicSchemeV1
 	}
-	return []*events.IAMPolicyDocument{&policyDoc}
+	return deviceTopicScheme
 }
@@ -0,0 +1,107 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Default timeout for requests to the device registry endpoint.
+	defaultDeviceRegistryTimeout = time.Millisecond * 500
+
+	// Default number of devices, and the duration for which they are cached,
+	// when the device registry is an HTTP endpoint.
+	defaultDeviceRegistryCacheSize = 10000
+	defaultDeviceRegistryCacheTTL  = time.Minute * 5
+)
+
+// DeviceRecord is the entry of a device in the device registry.
+type DeviceRecord struct {
+	// ID of the device, which is the subject of its access tokens.
+	DeviceID string `json:"device_id" yaml:"device_id"`
+
+	// ID of the tenant in which the device is enrolled. If not specified, the
+	// tenant of the device is not checked.
+	TenantID string `json:"tenant_id" yaml:"tenant_id"`
+
+	// Whether the device has been locked, eg: because it was reported lost.
+	Locked bool `json:"locked" yaml:"locked"`
+}
+
+// DeviceRegistry is the directory of enrolled devices, which is consulted to
+// verify that a device is still enrolled when it connects. Devices are
+// removed from the registry when they are unenrolled.
+type DeviceRegistry interface {
+	// GetDevice returns the entry of the device, or nil if the device is not
+	// in the registry.
+	GetDevice(ctx context.Context, deviceID string) (*DeviceRecord, error)
+}
+
+// deviceRegistry is the registry in which devices are looked up. It is nil
+// if no device registry is configured.
+var deviceRegistry DeviceRegistry
+
+// newDeviceRegistry creates a device registry loaded from the specified file,
+// or a cached registry that looks up devices at the specified HTTP endpoint.
+// If neither is specified, no registry is configured and nil is returned.
+func newDeviceRegistry(file string, registryUrl string, timeout time.Duration,
+	cacheSize int, cacheTTL time.Duration) (DeviceRegistry, error) {
+	switch {
+	case file != "" && registryUrl != "":
+		return nil, fmt.Errorf("%w: both a file and a URL are specified",
+			ErrInvalidDeviceRegistryConfig)
+
+	case file != "":
+		return newFileDeviceRegistry(file)
+
+	case registryUrl != "":
+		registry, err := newHttpDeviceRegistry(registryUrl, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return newCachedDeviceRegistry(registry, cacheSize, cacheTTL), nil
+	}
+	return nil, nil
+}
+
+// checkDeviceRegistration rejects device access tokens issued to devices that
+// are not in the device registry, have been locked, or are enrolled in a
+// tenant other than the one the token was issued to ('tid' claim). The tenant
+// is not checked for devices whose entry doesn't specify one.
+func checkDeviceRegistration(ctx context.Context, claims *DstsTokenClaims) error {
+	if deviceRegistry == nil || claims.TokenType != TokenTypeDeviceAccessToken {
+		return nil
+	}
+
+	device, err := deviceRegistry.GetDevice(ctx, claims.Subject)
+	if err != nil {
+		auditDenied(auditReasonDeviceRegistryUnavailable, claims,
+			zap.Error(err),
+		)
+		return fmt.Errorf("%w: %v", ErrDeviceRegistryUnavailable, err)
+	}
+
+	switch {
+	case device == nil:
+		auditDenied(auditReasonDeviceUnknown, claims)
+		return fmt.Errorf("%w: %s", ErrDeviceUnknown, claims.Subject)
+
+	case device.Locked:
+		auditDenied(auditReasonDeviceLocked, claims)
+		return fmt.Errorf("%w: %s", ErrDeviceLocked, claims.Subject)
+
+	case device.TenantID != "" && device.TenantID != claims.TenantID:
+		auditDenied(auditReasonDeviceWrongTenant, claims,
+			zap.String("Registered tenant ID:", device.TenantID),
+		)
+		return fmt.Errorf("%w: %s", ErrDeviceWrongTenant, claims.Subject)
+	}
+	return nil
+}
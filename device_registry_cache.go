@@ -0,0 +1,51 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// cachedDeviceRegistry caches the entries returned by a device registry,
+// including the absence of devices that are not in the registry, so that
+// devices that reconnect frequently don't cause a lookup each time. The least
+// recently used entry is evicted when the cache is full. Failed lookups are
+// not cached. It is safe for concurrent use.
+type cachedDeviceRegistry struct {
+	// Registry in which devices that are not cached are looked up.
+	registry DeviceRegistry
+
+	// Duration for which devices are cached.
+	ttl time.Duration
+
+	// Cached devices indexed by device ID.
+	cache *lruCache
+}
+
+func newCachedDeviceRegistry(registry DeviceRegistry, size int,
+	ttl time.Duration) *cachedDeviceRegistry {
+	return &cachedDeviceRegistry{
+		registry: registry,
+		ttl:      ttl,
+		cache:    newLruCache(size),
+	}
+}
+
+// GetDevice returns the cached entry of the device, or looks up the device in
+// the underlying registry if it isn't cached or its entry has expired.
+func (c *cachedDeviceRegistry) GetDevice(ctx context.Context,
+	deviceID string) (*DeviceRecord, error) {
+	if entry, ok := c.cache.get(deviceID); ok {
+		return entry.(*DeviceRecord), nil
+	}
+
+	device, err := c.registry.GetDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.add(deviceID, device, time.Now().Add(c.ttl))
+	return device, nil
+}
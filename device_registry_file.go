@@ -0,0 +1,112 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Header of the columns of a device registry CSV file.
+const deviceRegistryCsvHeader = "device_id"
+
+// fileDeviceRegistry is a device registry loaded from a local file when the
+// lambda starts.
+type fileDeviceRegistry struct {
+	// Device entries indexed by device ID.
+	devices map[string]*DeviceRecord
+}
+
+// newFileDeviceRegistry loads the device registry from the specified file. A
+// file with the '.csv' extension contains one device per line, with the
+// columns: device_id, tenant_id, locked. Other files contain a JSON or YAML
+// array of device entries.
+func newFileDeviceRegistry(path string) (*fileDeviceRegistry, error) {
+	var records []*DeviceRecord
+	var err error
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		records, err = parseDeviceRegistryCsv(path)
+	} else {
+		err = loadConfigFile(path, &records)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidDeviceRegistryConfig,
+			path, err)
+	}
+
+	registry := &fileDeviceRegistry{
+		devices: make(map[string]*DeviceRecord, len(records)),
+	}
+	for i, record := range records {
+		if record == nil || record.DeviceID == "" {
+			return nil, fmt.Errorf("%w: %s: device %d: no device ID specified",
+				ErrInvalidDeviceRegistryConfig, path, i)
+		}
+		registry.devices[record.DeviceID] = record
+	}
+
+	iotLogger.Info("Loaded device registry.",
+		zap.String("Path:", path),
+		zap.Int("Device count:", len(registry.devices)),
+	)
+	return registry, nil
+}
+
+// parseDeviceRegistryCsv reads the device entries from the specified CSV file.
+// An optional header row and lines starting with '#' are ignored.
+func parseDeviceRegistryCsv(path string) ([]*DeviceRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*DeviceRecord, 0, len(rows))
+	for i, row := range rows {
+		if i == 0 && row[0] == deviceRegistryCsvHeader {
+			continue
+		}
+		if len(row) > 3 {
+			return nil, fmt.Errorf("line %d: too many columns", i+1)
+		}
+
+		record := &DeviceRecord{DeviceID: row[0]}
+		if len(row) > 1 {
+			record.TenantID = row[1]
+		}
+		if len(row) > 2 && row[2] != "" {
+			record.Locked, err = strconv.ParseBool(row[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid locked value: %s",
+					i+1, row[2])
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// GetDevice returns the entry of the device, or nil if the device is not in
+// the registry.
+func (r *fileDeviceRegistry) GetDevice(ctx context.Context,
+	deviceID string) (*DeviceRecord, error) {
+	return r.devices[deviceID], nil
+}
@@ -0,0 +1,89 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// httpDeviceRegistry looks up devices at an HTTP endpoint. The entry of a
+// device is requested from the URL of the endpoint followed by the device ID,
+// eg: https://devices.example.com/v1/devices/<device ID>. The endpoint
+// returns 404 Not Found for devices that are not in the registry.
+type httpDeviceRegistry struct {
+	// URL of the endpoint, without a trailing slash.
+	url string
+
+	// HTTP client used for requests to the endpoint, with a strict timeout.
+	client *http.Client
+}
+
+// newHttpDeviceRegistry configures the device registry at the specified URL.
+func newHttpDeviceRegistry(registryUrl string,
+	timeout time.Duration) (*httpDeviceRegistry, error) {
+	parsedUrl, err := url.Parse(registryUrl)
+	if err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") ||
+		parsedUrl.Host == "" {
+		return nil, fmt.Errorf("%w: invalid URL: %s",
+			ErrInvalidDeviceRegistryConfig, registryUrl)
+	}
+
+	return &httpDeviceRegistry{
+		url:    strings.TrimSuffix(registryUrl, "/"),
+		client: newServiceHttpClient(timeout),
+	}, nil
+}
+
+// GetDevice requests the entry of the device from the endpoint. It returns
+// nil if the device is not in the registry.
+func (r *httpDeviceRegistry) GetDevice(ctx context.Context,
+	deviceID string) (*DeviceRecord, error) {
+	deviceUrl := r.url + "/" + url.PathEscape(deviceID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, deviceUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(headerUserAgent, authorizerUserAgent)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, &HTTPStatusError{
+			URL:        deviceUrl,
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	body, err := readLimitedBody(resp, deviceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	var device DeviceRecord
+	err = json.Unmarshal(body, &device)
+	if err != nil {
+		return nil, err
+	}
+	if device.DeviceID != "" && device.DeviceID != deviceID {
+		return nil, fmt.Errorf("registry returned the entry of device %s",
+			device.DeviceID)
+	}
+	device.DeviceID = deviceID
+	return &device, nil
+}
@@ -0,0 +1,214 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Devices in the test registry.
+var testDevices = []*DeviceRecord{
+	{DeviceID: "dev-1", TenantID: "t1"},
+	{DeviceID: "dev-2", TenantID: "t1", Locked: true},
+	{DeviceID: "dev-3"},
+}
+
+// setDeviceRegistry sets the device registry for the duration of the test.
+func setDeviceRegistry(t *testing.T, registry DeviceRegistry) {
+	oldRegistry := deviceRegistry
+	deviceRegistry = registry
+	t.Cleanup(func() {
+		deviceRegistry = oldRegistry
+	})
+}
+
+// newTestRegistryServer starts a device registry endpoint serving the test
+// devices, and returns the server and a counter of the requests it received.
+func newTestRegistryServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	requests := new(atomic.Int32)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			deviceID := strings.TrimPrefix(r.URL.Path, "/devices/")
+			if deviceID == "unavailable" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if deviceID == "impostor" {
+				_ = json.NewEncoder(w).Encode(testDevices[0])
+				return
+			}
+			for _, device := range testDevices {
+				if device.DeviceID == deviceID {
+					_ = json.NewEncoder(w).Encode(device)
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+// checkTestDevice checks the registration of a device presenting a device
+// access token issued in the specified tenant.
+func checkTestDevice(deviceID string, tenantID string) error {
+	claims := &DstsTokenClaims{
+		TokenType: TokenTypeDeviceAccessToken,
+		TenantID:  tenantID,
+	}
+	claims.Subject = deviceID
+	return checkDeviceRegistration(context.Background(), claims)
+}
+
+// testDeviceRegistrationChecks are the checks applied to the test devices,
+// whichever registry they are loaded from.
+var testDeviceRegistrationChecks = []struct {
+	name     string
+	deviceID string
+	tenantID string
+	wantErr  error
+}{
+	{"registered", "dev-1", "t1", nil},
+	{"unknown", "dev-4", "t1", ErrDeviceUnknown},
+	{"locked", "dev-2", "t1", ErrDeviceLocked},
+	{"wrong tenant", "dev-1", "t2", ErrDeviceWrongTenant},
+	{"no tenant in token", "dev-1", "", ErrDeviceWrongTenant},
+	{"no tenant in registry", "dev-3", "t2", nil},
+}
+
+func TestFileDeviceRegistry(t *testing.T) {
+	initLogger()
+	dir := t.TempDir()
+	files := map[string]string{
+		"devices.csv": "device_id,tenant_id,locked\n" +
+			"# Enrolled devices\n" +
+			"dev-1,t1,false\n" +
+			"dev-2,t1,true\n" +
+			"dev-3\n",
+		"devices.yaml": "- device_id: dev-1\n  tenant_id: t1\n" +
+			"- device_id: dev-2\n  tenant_id: t1\n  locked: true\n" +
+			"- device_id: dev-3\n",
+		"devices.json": `[{"device_id": "dev-1", "tenant_id": "t1"},
+			{"device_id": "dev-2", "tenant_id": "t1", "locked": true},
+			{"device_id": "dev-3"}]`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			err := os.WriteFile(path, []byte(content), 0600)
+			if err != nil {
+				t.Fatalf("failed to write the registry file: %v", err)
+			}
+
+			registry, err := newDeviceRegistry(path, "", time.Second, 10,
+				time.Minute)
+			if err != nil {
+				t.Fatalf("failed to load the registry: %v", err)
+			}
+			setDeviceRegistry(t, registry)
+
+			for _, tt := range testDeviceRegistrationChecks {
+				err = checkTestDevice(tt.deviceID, tt.tenantID)
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("%s: expected error %v, got %v", tt.name,
+						tt.wantErr, err)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidDeviceRegistryFile(t *testing.T) {
+	initLogger()
+	dir := t.TempDir()
+	files := map[string]string{
+		"no_device_id.yaml":  "- tenant_id: t1\n",
+		"unknown_field.json": `[{"device_id": "dev-1", "tennant_id": "t1"}]`,
+		"invalid_locked.csv": "dev-1,t1,maybe\n",
+		"extra_column.csv":   "dev-1,t1,false,extra\n",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("failed to write the registry file: %v", err)
+		}
+
+		_, err = newDeviceRegistry(path, "", time.Second, 10, time.Minute)
+		if !errors.Is(err, ErrInvalidDeviceRegistryConfig) {
+			t.Errorf("%s: expected ErrInvalidDeviceRegistryConfig, got %v",
+				name, err)
+		}
+	}
+
+	_, err := newDeviceRegistry(filepath.Join(dir, "devices.csv"),
+		"https://devices.example.com/devices", time.Second, 10, time.Minute)
+	if !errors.Is(err, ErrInvalidDeviceRegistryConfig) {
+		t.Errorf("expected ErrInvalidDeviceRegistryConfig, got %v", err)
+	}
+}
+
+func TestHttpDeviceRegistry(t *testing.T) {
+	initLogger()
+	server, requests := newTestRegistryServer(t)
+	registry, err := newDeviceRegistry("", server.URL+"/devices/", time.Second,
+		10, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to configure the registry: %v", err)
+	}
+	setDeviceRegistry(t, registry)
+
+	for _, tt := range testDeviceRegistrationChecks {
+		err = checkTestDevice(tt.deviceID, tt.tenantID)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+
+	// Devices that are found, or not found, are cached.
+	if requests.Load() != 4 {
+		t.Errorf("expected 4 requests, got %d", requests.Load())
+	}
+
+	// Failed lookups, and entries of other devices, are not cached.
+	for _, deviceID := range []string{"unavailable", "impostor"} {
+		for i := 0; i < 2; i++ {
+			err = checkTestDevice(deviceID, "t1")
+			if !errors.Is(err, ErrDeviceRegistryUnavailable) {
+				t.Errorf("%s: expected ErrDeviceRegistryUnavailable, got %v",
+					deviceID, err)
+			}
+		}
+	}
+	if requests.Load() != 8 {
+		t.Errorf("expected 8 requests, got %d", requests.Load())
+	}
+}
+
+func TestDeviceRegistryIgnoresAppTokens(t *testing.T) {
+	initLogger()
+	setDeviceRegistry(t, &fileDeviceRegistry{})
+
+	claims := &DstsTokenClaims{TokenType: TokenTypeAppAccessToken}
+	claims.Subject = schedulerAppID
+	err := checkDeviceRegistration(context.Background(), claims)
+	if err != nil {
+		t.Errorf("expected app access tokens not to be checked, got %v", err)
+	}
+}
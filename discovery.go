@@ -0,0 +1,161 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Path of the OpenID provider configuration relative to the issuer URL.
+	// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderConfig
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+	// Default interval after which the OpenID provider configuration is
+	// rediscovered.
+	defaultOidcDiscoveryInterval = time.Hour * 12
+)
+
+// oidcProviderMetadata contains the fields of the OpenID provider
+// configuration used by the authorizer.
+type oidcProviderMetadata struct {
+	Issuer            string   `json:"issuer"`
+	JwksUri           string   `json:"jwks_uri"`
+	SigningAlgorithms []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// oidcDiscovery resolves the JWKS endpoint and signing algorithms of an
+// issuer using OpenID Connect discovery. The discovered configuration is
+// cached and periodically rediscovered, so that endpoint moves do not need
+// configuration changes.
+type oidcDiscovery struct {
+	// Expected value of the issuer in the discovered configuration.
+	issuer string
+
+	// URL of the OpenID provider configuration.
+	discoveryUrl string
+
+	// Interval after which the configuration is rediscovered.
+	interval time.Duration
+
+	// Protects the fields below.
+	lock sync.RWMutex
+
+	// Last successfully discovered configuration.
+	metadata *oidcProviderMetadata
+
+	// Time at which the configuration must be rediscovered.
+	expiresAt time.Time
+}
+
+func newOidcDiscovery(issuer string, issuerUrl string,
+	interval time.Duration) (*oidcDiscovery, error) {
+	parsedUrl, err := url.Parse(issuerUrl)
+	if err != nil || (parsedUrl.Scheme != "https" && parsedUrl.Scheme != "http") ||
+		parsedUrl.Host == "" {
+		return nil, fmt.Errorf("%w: issuer %q specifies an invalid issuer URL: %s",
+			ErrInvalidIssuerConfig, issuer, issuerUrl)
+	}
+
+	return &oidcDiscovery{
+		issuer:       issuer,
+		discoveryUrl: strings.TrimSuffix(issuerUrl, "/") + oidcDiscoveryPath,
+		interval:     interval,
+	}, nil
+}
+
+// getMetadata returns the discovered OpenID provider configuration,
+// rediscovering it if the cached configuration has expired. If rediscovery
+// fails, the last successfully discovered configuration is returned.
+func (d *oidcDiscovery) getMetadata(ctx context.Context) (*oidcProviderMetadata, error) {
+	d.lock.RLock()
+	cachedMetadata, expiresAt := d.metadata, d.expiresAt
+	d.lock.RUnlock()
+
+	if cachedMetadata != nil && time.Now().Before(expiresAt) {
+		return cachedMetadata, nil
+	}
+
+	// The lock is not held while discovering the configuration, so that
+	// token validation is not blocked on the discovery endpoint.
+	metadata, err := d.discover(ctx)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err != nil {
+		iotLogger.Error("Failed to discover the OpenID provider configuration!",
+			zap.String("Issuer:", d.issuer),
+			zap.String("Discovery URL:", d.discoveryUrl),
+			zap.Error(err),
+		)
+		if d.metadata == nil {
+			return nil, err
+		}
+
+		// Continue using the last discovered configuration and retry later.
+		d.expiresAt = time.Now().Add(jwksRefreshRetryInterval)
+		return d.metadata, nil
+	}
+
+	if d.metadata == nil || d.metadata.JwksUri != metadata.JwksUri {
+		iotLogger.Info("Discovered JWKS endpoint for issuer.",
+			zap.String("Issuer:", d.issuer),
+			zap.String("JWKS URL:", metadata.JwksUri),
+			zap.Strings("Signing algorithms:", metadata.SigningAlgorithms),
+		)
+	}
+	d.metadata = metadata
+	d.expiresAt = time.Now().Add(d.interval)
+	return d.metadata, nil
+}
+
+// signingAlgorithms returns the signing algorithms advertised by the issuer,
+// if its configuration has been discovered.
+func (d *oidcDiscovery) signingAlgorithms() []string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	if d.metadata == nil {
+		return nil
+	}
+	return d.metadata.SigningAlgorithms
+}
+
+// discover retrieves and validates the OpenID provider configuration.
+func (d *oidcDiscovery) discover(ctx context.Context) (*oidcProviderMetadata, error) {
+	metadataBytes, _, err := getFromServer(ctx, d.discoveryUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata oidcProviderMetadata
+	err = json.Unmarshal(metadataBytes, &metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	// The discovered configuration must belong to the expected issuer.
+	// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderConfigurationValidation
+	if metadata.Issuer != d.issuer {
+		return nil, fmt.Errorf("%w: discovered issuer %q does not match %q",
+			ErrInvalidIssuerConfig, metadata.Issuer, d.issuer)
+	}
+
+	jwksUri, err := url.Parse(metadata.JwksUri)
+	if err != nil || (jwksUri.Scheme != "https" && jwksUri.Scheme != "http") ||
+		jwksUri.Host == "" {
+		return nil, fmt.Errorf("%w: discovered an invalid JWKS URL: %q",
+			ErrInvalidIssuerConfig, metadata.JwksUri)
+	}
+	return &metadata, nil
+}
@@ -6,18 +6,70 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 )
 
 var (
-	ErrNoLambdaContext              = errors.New("failed to retrieve context from lambda function")
-	ErrMissingAssets                = errors.New("required assets are missing to create a public key")
-	ErrInvalidToken                 = errors.New("invalid token provided")
-	ErrInvalidTokenHeaderKid        = errors.New("invalid token signing kid specified")
-	ErrInvalidTokenHeaderSigningAlg = errors.New("invalid token signing algorithm specified")
-	ErrInvalidIssuerClaim           = errors.New("specified token contains an invalid issuer claim")
-	ErrInvalidAudienceClaim         = errors.New("specified token contains an invalid audience claim")
-	ErrOverflowDetected             = errors.New("integer overflow detected while parsing exponent from the JWKS")
-	ErrUnauthorized                 = errors.New(http.StatusText(http.StatusUnauthorized))
-	ErrBadRequest                   = errors.New(http.StatusText(http.StatusBadRequest))
+	ErrNoLambdaContext               = errors.New("failed to retrieve context from lambda function")
+	ErrMissingAssets                 = errors.New("required assets are missing to create a public key")
+	ErrInvalidToken                  = errors.New("invalid token provided")
+	ErrInvalidTokenHeaderKid         = errors.New("invalid token signing kid specified")
+	ErrInvalidTokenHeaderSigningAlg  = errors.New("invalid token signing algorithm specified")
+	ErrUnknownSigningKey             = errors.New("no signing key found for the specified kid")
+	ErrDisallowedSigningAlg          = fmt.Errorf("%w: algorithm is not allowed", ErrInvalidTokenHeaderSigningAlg)
+	ErrSigningKeyAlgMismatch         = fmt.Errorf("%w: algorithm does not match the signing key", ErrInvalidTokenHeaderSigningAlg)
+	ErrInvalidIssuerClaim            = errors.New("specified token contains an invalid issuer claim")
+	ErrInvalidIssuerConfig           = errors.New("invalid trusted issuer configuration specified")
+	ErrInvalidTokenType              = errors.New("specified token type is not accepted")
+	ErrTokenRevoked                  = errors.New("specified token has been revoked")
+	ErrTenantSuspended               = errors.New("tenant of the specified token has been suspended")
+	ErrInvalidTopicScheme            = errors.New("invalid device topic scheme specified")
+	ErrInvalidMissingMsClaimBehavior = errors.New("invalid handling of a missing ms claim specified")
+	ErrMissingMsClaim                = errors.New("management service (ms) claim was not specified")
+	ErrInvalidPolicyTemplate         = errors.New("invalid policy template specified")
+	ErrUnknownPolicyTemplate         = errors.New("specified policy template does not exist")
+	ErrInvalidAuthorizationRule      = errors.New("invalid authorization rule specified")
+	ErrConditionNotMet               = errors.New("authorization condition not met")
+	ErrInvalidPdpConfig              = errors.New("invalid policy decision point configuration specified")
+	ErrPdpUnavailable                = errors.New("policy decision point is unavailable")
+	ErrInvalidDeviceRegistryConfig   = errors.New("invalid device registry configuration specified")
+	ErrDeviceRegistryUnavailable     = errors.New("device registry is unavailable")
+	ErrDeviceUnknown                 = errors.New("device is not enrolled in the device registry")
+	ErrDeviceLocked                  = errors.New("device has been locked")
+	ErrDeviceWrongTenant             = errors.New("device is enrolled in a different tenant")
+	ErrInvalidPrincipalID            = errors.New("invalid principal ID")
+	ErrInvalidTopicClaim             = errors.New("claim cannot be used in a topic")
+	ErrInvalidListConfig             = errors.New("invalid list configuration specified")
+	ErrListUnavailable               = errors.New("list has not been loaded")
+	ErrInvalidAudienceClaim          = errors.New("specified token contains an invalid audience claim")
+	ErrMissingKid                    = errors.New("signing key does not specify a kid")
+	ErrDuplicateKid                  = errors.New("signing key specifies a kid used by another key")
+	ErrNoSigningKeys                 = errors.New("no valid signing keys found in the JWKS")
+	ErrNoJwksSnapshot                = errors.New("no JWKS snapshot found for the issuer")
+	ErrMissingX5c                    = errors.New("signing key does not specify a certificate chain")
+	ErrInvalidX5c                    = errors.New("signing key specifies an invalid certificate chain")
+	ErrX5cKeyMismatch                = errors.New("signing key does not match its certificate")
+	ErrX5cThumbprintMismatch         = errors.New("signing key thumbprint does not match its certificate")
+	ErrInvalidPemKey                 = errors.New("invalid PEM encoded signing key")
+	ErrUnsupportedCurve              = errors.New("unsupported elliptic curve specified in the JWKS")
+	ErrInvalidCurvePoint             = errors.New("invalid elliptic curve public key specified in the JWKS")
+	ErrOverflowDetected              = errors.New("integer overflow detected while parsing exponent from the JWKS")
+	ErrInvalidHttpClientConfig       = errors.New("invalid HTTP client configuration specified")
+	ErrCircuitOpen                   = errors.New("requests to the endpoint are suspended after repeated failures")
+	ErrResponseTooLarge              = errors.New("response exceeds the maximum allowed size")
+	ErrUnauthorized                  = errors.New(http.StatusText(http.StatusUnauthorized))
+	ErrBadRequest                    = errors.New(http.StatusText(http.StatusBadRequest))
 )
+
+// HTTPStatusError is returned when a request to the DSTS fails with an
+// unexpected HTTP status code.
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("request to %s failed with HTTP status %d (%s)",
+		e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
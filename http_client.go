@@ -0,0 +1,144 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHttpRequestTimeout = time.Second * 3
+	defaultTLSMinVersion      = "1.2"
+)
+
+// jwksHttpClient is the HTTP client used to retrieve resources from the
+// DSTS. It is created once at startup and reused across invocations, so
+// that connections to the DSTS are kept alive.
+var jwksHttpClient = &http.Client{Timeout: defaultHttpRequestTimeout}
+
+// httpClientConfig specifies the transport used to connect to the DSTS.
+type httpClientConfig struct {
+	// Path to a PEM file containing additional CA certificates trusted to
+	// issue the DSTS server certificate, eg: the CA of an egress proxy.
+	caBundleFile string
+
+	// Paths to the PEM encoded client certificate and private key presented
+	// to the DSTS, if it requires mutual TLS.
+	clientCertFile string
+	clientKeyFile  string
+
+	// URL of the proxy used to connect to the DSTS. If not specified, the
+	// proxy is determined using the HTTPS_PROXY and NO_PROXY environment
+	// variables.
+	proxyUrl string
+
+	// Timeout for requests to the DSTS, including connection setup.
+	requestTimeout time.Duration
+
+	// Minimum TLS version accepted (1.2 or 1.3).
+	tlsMinVersion string
+}
+
+// newJwksHttpClient creates the HTTP client used to connect to the DSTS.
+func newJwksHttpClient(config httpClientConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	switch config.tlsMinVersion {
+	case "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("%w: unsupported TLS version: %q",
+			ErrInvalidHttpClientConfig, config.tlsMinVersion)
+	}
+
+	if config.caBundleFile != "" {
+		caBundle, err := os.ReadFile(config.caBundleFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidHttpClientConfig, err)
+		}
+
+		// Trust the specified CAs in addition to the system CAs.
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("%w: no certificates found in CA bundle %s",
+				ErrInvalidHttpClientConfig, config.caBundleFile)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if (config.clientCertFile == "") != (config.clientKeyFile == "") {
+		return nil, fmt.Errorf("%w: both the client certificate and key must be specified",
+			ErrInvalidHttpClientConfig)
+	}
+	if config.clientCertFile != "" {
+		clientCert, err := tls.LoadX509KeyPair(config.clientCertFile,
+			config.clientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidHttpClientConfig, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if config.proxyUrl != "" {
+		parsedProxyUrl, err := url.Parse(config.proxyUrl)
+		if err != nil || parsedProxyUrl.Host == "" {
+			return nil, fmt.Errorf("%w: invalid proxy URL: %q",
+				ErrInvalidHttpClientConfig, config.proxyUrl)
+		}
+		proxy = http.ProxyURL(parsedProxyUrl)
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   config.requestTimeout,
+			KeepAlive: time.Second * 30,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   config.requestTimeout,
+		ResponseHeaderTimeout: config.requestTimeout,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       time.Second * 90,
+	}
+
+	iotLogger.Info("Configured HTTP client for the DSTS.",
+		zap.String("CA bundle:", config.caBundleFile),
+		zap.Bool("Mutual TLS:", config.clientCertFile != ""),
+		zap.String("Proxy URL:", config.proxyUrl),
+		zap.Duration("Request timeout:", config.requestTimeout),
+		zap.String("TLS minimum version:", config.tlsMinVersion),
+	)
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.requestTimeout,
+	}, nil
+}
+
+// newServiceHttpClient creates an HTTP client, with its own transport using
+// the default settings, for requests to services other than the DSTS. The
+// CA bundle, client certificate and proxy configured for the DSTS are not
+// used for other services.
+func newServiceHttpClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: http.DefaultTransport.(*http.Transport).Clone(),
+		Timeout:   timeout,
+	}
+}
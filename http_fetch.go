@@ -0,0 +1,234 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Maximum size of a response accepted from the DSTS.
+	maxResponseSize = 1024 * 1024
+
+	// Number of attempts made to retrieve a resource from the DSTS, and the
+	// bounds of the exponential backoff applied between attempts.
+	defaultFetchMaxAttempts = 3
+	fetchRetryBaseDelay     = time.Millisecond * 200
+	fetchRetryMaxDelay      = time.Second * 2
+
+	// Number of consecutive failed requests after which requests to an
+	// endpoint are suspended, and the duration for which they are suspended.
+	circuitBreakerFailureThreshold = 5
+	circuitBreakerOpenDuration     = time.Second * 30
+)
+
+var (
+	// Number of attempts made to retrieve a resource from the DSTS.
+	fetchMaxAttempts = defaultFetchMaxAttempts
+
+	// Circuit breakers for the endpoints requested, indexed by URL.
+	circuitBreakers     = map[string]*circuitBreaker{}
+	circuitBreakersLock sync.Mutex
+)
+
+// circuitBreaker stops requests to an endpoint that is failing consistently,
+// so that a struggling DSTS is not hammered with requests. Once the breaker
+// has been open for a while, a single trial request is let through. The
+// breaker is closed if the trial request succeeds.
+type circuitBreaker struct {
+	lock sync.Mutex
+
+	// Number of consecutive failed requests.
+	failures int
+
+	// Time until which requests are not allowed.
+	openUntil time.Time
+
+	// Set while a trial request is in progress.
+	trialInProgress bool
+}
+
+func getCircuitBreaker(resourceUrl string) *circuitBreaker {
+	circuitBreakersLock.Lock()
+	defer circuitBreakersLock.Unlock()
+
+	breaker, ok := circuitBreakers[resourceUrl]
+	if !ok {
+		breaker = &circuitBreaker{}
+		circuitBreakers[resourceUrl] = breaker
+	}
+	return breaker
+}
+
+// allow checks whether a request may be made to the endpoint.
+func (b *circuitBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.failures < circuitBreakerFailureThreshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.trialInProgress {
+		return false
+	}
+	b.trialInProgress = true
+	return true
+}
+
+// record records the outcome of a request to the endpoint.
+func (b *circuitBreaker) record(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.trialInProgress = false
+	if err == nil {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= circuitBreakerFailureThreshold {
+		b.openUntil = time.Now().Add(circuitBreakerOpenDuration)
+	}
+}
+
+// Retrieve the token signing keys in JWKS format from the DSTS JWKS endpoint,
+// or the OpenID provider metadata from the issuer's discovery endpoint.
+// The response headers are returned so that the caller can honor the caching
+// directives specified by the DSTS. Failed requests are retried with
+// exponential backoff, as long as the retry can be made before the deadline
+// of the context.
+func getFromServer(ctx context.Context,
+	resourceUrl string) (body []byte, header http.Header, err error) {
+	breaker := getCircuitBreaker(resourceUrl)
+	if !breaker.allow() {
+		return nil, nil, fmt.Errorf("%w: %s", ErrCircuitOpen, resourceUrl)
+	}
+
+	for attempt := 1; ; attempt++ {
+		body, header, err = getFromServerOnce(ctx, resourceUrl)
+		if err == nil || attempt >= fetchMaxAttempts ||
+			!isRetryableError(err) || ctx.Err() != nil {
+			break
+		}
+
+		// Don't wait for a retry that cannot be made before the deadline.
+		delay := retryDelay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+			break
+		}
+
+		iotLogger.Warn("Retrying HTTP request to the DSTS endpoint.",
+			zap.String("URL:", resourceUrl),
+			zap.Int("Attempt:", attempt),
+			zap.Duration("Delay:", delay),
+			zap.Error(err),
+		)
+		if !sleepContext(ctx, delay) {
+			break
+		}
+	}
+
+	breaker.record(err)
+	return body, header, err
+}
+
+func getFromServerOnce(ctx context.Context,
+	resourceUrl string) (body []byte, header http.Header, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, resourceUrl, nil)
+	if err != nil {
+		iotLogger.Error("Failed to create HTTP request to the DSTS endpoint!",
+			zap.String("URL:", resourceUrl),
+			zap.Error(err),
+		)
+		return nil, nil, err
+	}
+
+	req.Header.Set(headerUserAgent, authorizerUserAgent)
+	resp, err := jwksHttpClient.Do(req)
+	if err != nil {
+		iotLogger.Error("Failed to retrieve resource from DSTS!",
+			zap.String("URL:", resourceUrl),
+			zap.Error(err),
+		)
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		iotLogger.Error("HTTP request to the DSTS endpoint failed!",
+			zap.String("URL:", resourceUrl),
+			zap.Int("status", resp.StatusCode))
+		return nil, nil, &HTTPStatusError{
+			URL:        resourceUrl,
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	body, err = readLimitedBody(resp, resourceUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, resp.Header, nil
+}
+
+// readLimitedBody reads the body of the response to a request to the URL,
+// failing if it is larger than maxResponseSize.
+func readLimitedBody(resp *http.Response, resourceUrl string) ([]byte, error) {
+	// Read one byte more than allowed to detect oversized responses.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxResponseSize {
+		return nil, fmt.Errorf("%w: %s", ErrResponseTooLarge, resourceUrl)
+	}
+	return body, nil
+}
+
+// isRetryableError checks whether a failed request may succeed if retried.
+// Requests that failed due to network errors, server errors or throttling
+// are retried.
+func isRetryableError(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError ||
+			statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	return !errors.Is(err, ErrResponseTooLarge)
+}
+
+// sleepContext waits for the specified delay. It returns false if the context
+// is done before the delay elapses.
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryDelay returns the delay before the next attempt, using exponential
+// backoff with full jitter.
+func retryDelay(attempt int) time.Duration {
+	delay := fetchRetryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > fetchRetryMaxDelay {
+		delay = fetchRetryMaxDelay
+	}
+	return time.Duration(rand.Int64N(int64(delay))) + time.Millisecond
+}
@@ -0,0 +1,187 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setFetchMaxAttempts sets the number of attempts made to retrieve a resource
+// for the duration of the test.
+func setFetchMaxAttempts(t *testing.T, attempts int) {
+	oldAttempts := fetchMaxAttempts
+	fetchMaxAttempts = attempts
+	t.Cleanup(func() {
+		fetchMaxAttempts = oldAttempts
+	})
+}
+
+// newTestFetchServer starts a server that responds to each request with the
+// next of the status codes, repeating the last one, and returns the server
+// and a counter of the requests it received. Successful responses have a body
+// of the specified size.
+func newTestFetchServer(t *testing.T, bodySize int,
+	statusCodes ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	requests := new(atomic.Int32)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			count := int(requests.Add(1))
+			statusCode := statusCodes[min(count, len(statusCodes))-1]
+			w.WriteHeader(statusCode)
+			if statusCode == http.StatusOK {
+				_, _ = w.Write([]byte(strings.Repeat("a", bodySize)))
+			}
+		}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestGetFromServerRetries(t *testing.T) {
+	initLogger()
+	tests := []struct {
+		name         string
+		bodySize     int
+		statusCodes  []int
+		wantErr      bool
+		wantRequests int32
+	}{
+		{"success", 10, []int{http.StatusOK}, false, 1},
+		{"server error", 10, []int{http.StatusInternalServerError}, true, 3},
+		{"throttled", 10, []int{http.StatusTooManyRequests}, true, 3},
+		{"recovered", 10, []int{http.StatusServiceUnavailable, http.StatusOK},
+			false, 2},
+		{"client error", 10, []int{http.StatusNotFound}, true, 1},
+		{"oversized body", maxResponseSize + 1, []int{http.StatusOK}, true, 1},
+	}
+	for _, tt := range tests {
+		server, requests := newTestFetchServer(t, tt.bodySize, tt.statusCodes...)
+		body, _, err := getFromServer(context.Background(), server.URL)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if err == nil && len(body) != tt.bodySize {
+			t.Errorf("%s: unexpected body size %d", tt.name, len(body))
+		}
+		if requests.Load() != tt.wantRequests {
+			t.Errorf("%s: expected %d requests, got %d", tt.name,
+				tt.wantRequests, requests.Load())
+		}
+	}
+}
+
+func TestGetFromServerDeadline(t *testing.T) {
+	initLogger()
+	setFetchMaxAttempts(t, 100)
+	server, requests := newTestFetchServer(t, 0, http.StatusServiceUnavailable)
+
+	// Retries stop at the deadline of the context.
+	deadline := time.Millisecond * 300
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	start := time.Now()
+	_, _, err := getFromServer(ctx, server.URL)
+	elapsed := time.Since(start)
+
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) && !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if elapsed > deadline+time.Millisecond*100 {
+		t.Errorf("retries continued after the deadline: %v", elapsed)
+	}
+	if requests.Load() < 2 || requests.Load() >= 100 {
+		t.Errorf("unexpected number of requests: %d", requests.Load())
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	errFailed := errors.New("request failed")
+	breaker := &circuitBreaker{}
+
+	// The breaker opens after consecutive failures.
+	for i := 0; i < circuitBreakerFailureThreshold; i++ {
+		if !breaker.allow() {
+			t.Fatalf("breaker opened after %d failures", i)
+		}
+		breaker.record(errFailed)
+	}
+	if breaker.allow() {
+		t.Fatalf("breaker not opened after %d failures",
+			circuitBreakerFailureThreshold)
+	}
+
+	// Once it has been open for a while, a single trial request is allowed,
+	// and the breaker opens again if it fails.
+	breaker.openUntil = time.Now()
+	if !breaker.allow() {
+		t.Fatalf("trial request not allowed")
+	}
+	if breaker.allow() {
+		t.Errorf("concurrent trial request allowed")
+	}
+	breaker.record(errFailed)
+	if breaker.allow() {
+		t.Errorf("breaker not opened after a failed trial request")
+	}
+
+	// The breaker closes if the trial request succeeds.
+	breaker.openUntil = time.Now()
+	if !breaker.allow() {
+		t.Fatalf("trial request not allowed")
+	}
+	breaker.record(nil)
+	for i := 0; i < 2; i++ {
+		if !breaker.allow() {
+			t.Errorf("breaker not closed after a successful trial request")
+		}
+	}
+}
+
+func TestGetFromServerCircuitOpen(t *testing.T) {
+	initLogger()
+	setFetchMaxAttempts(t, 1)
+	server, requests := newTestFetchServer(t, 0, http.StatusInternalServerError)
+
+	// Requests to an endpoint are suspended once the breaker opens.
+	for i := 0; i < circuitBreakerFailureThreshold+2; i++ {
+		_, _, err := getFromServer(context.Background(), server.URL)
+		if i >= circuitBreakerFailureThreshold && !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("request %d: expected ErrCircuitOpen, got %v", i, err)
+		}
+	}
+	if requests.Load() != circuitBreakerFailureThreshold {
+		t.Errorf("expected %d requests, got %d", circuitBreakerFailureThreshold,
+			requests.Load())
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&HTTPStatusError{StatusCode: http.StatusInternalServerError}, true},
+		{&HTTPStatusError{StatusCode: http.StatusBadGateway}, true},
+		{&HTTPStatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&HTTPStatusError{StatusCode: http.StatusNotFound}, false},
+		{&HTTPStatusError{StatusCode: http.StatusForbidden}, false},
+		{fmt.Errorf("%w: https://dsts.example.com", ErrResponseTooLarge), false},
+		{errors.New("connection refused"), true},
+	}
+	for _, tt := range tests {
+		if isRetryableError(tt.err) != tt.want {
+			t.Errorf("%v: expected retryable %v", tt.err, tt.want)
+		}
+	}
+}
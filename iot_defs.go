@@ -8,6 +8,13 @@ const (
 	defaultRefreshAfterSeconds    = 3600
 	defaultDisconnectAfterSeconds = 3600
 
+	// Limits imposed by AWS IoT Core on the refresh and disconnect intervals
+	// returned by custom authorizers.
+	minRefreshAfterSeconds    = 300
+	maxRefreshAfterSeconds    = 86400
+	minDisconnectAfterSeconds = 300
+	maxDisconnectAfterSeconds = 86400
+
 	protocolMqtt = "mqtt"
 	protocolHttp = "http"
 )
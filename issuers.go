@@ -0,0 +1,277 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// issuerConfig is the configuration of a trusted token issuer.
+type issuerConfig struct {
+	// Value of the 'iss' claim in tokens issued by the issuer.
+	Issuer string `json:"issuer"`
+
+	// URL of the issuer's JWKS endpoint.
+	JwksUrl string `json:"jwks_url,omitempty"`
+
+	// Base URL of the issuer. If specified instead of the JWKS URL, the JWKS
+	// endpoint and supported signing algorithms are resolved using OpenID
+	// Connect discovery.
+	IssuerUrl string `json:"issuer_url,omitempty"`
+
+	// Path to a local JWKS file containing the issuer's signing keys.
+	JwksFile string `json:"jwks_file,omitempty"`
+
+	// Path to a directory of PEM encoded public keys of the issuer, named
+	// after their kid.
+	PemDir string `json:"pem_dir,omitempty"`
+
+	// Path to a PEM file containing the root CAs that must certify the
+	// issuer's JWKS signing keys. Defaults to JWKS_X5C_ROOT_CA_FILE.
+	X5cRootCaFile string `json:"x5c_root_ca_file,omitempty"`
+
+	// Types of tokens ('typ' claim) accepted from the issuer. Defaults to
+	// device and app access tokens.
+	TokenTypes []string `json:"token_types,omitempty"`
+
+	// Signing algorithms accepted for tokens from the issuer. Defaults to the
+	// configured list of allowed signing algorithms.
+	SigningAlgorithms []string `json:"signing_algorithms,omitempty"`
+}
+
+// trustedIssuer is a token issuer whose access tokens are accepted by the
+// authorizer. Tokens claiming to be issued by the issuer are only verified
+// using the signing keys published at the issuer's JWKS endpoint.
+type trustedIssuer struct {
+	// Value of the 'iss' claim in tokens issued by the issuer. Issuers are
+	// matched exactly.
+	name string
+
+	// Provides the issuer's signing keys. Keys are looked up from the local
+	// JWKS file, the PEM directory and the JWKS endpoint, in that order.
+	keyProvider keyProvider
+
+	// Signing keys published at the issuer's JWKS endpoint, if configured.
+	keyStore *jwksKeyStore
+
+	// Types of tokens accepted from the issuer.
+	tokenTypes []string
+
+	// Signing algorithms accepted for tokens from the issuer.
+	signingAlgorithms []string
+
+	// Set if the issuer's configuration is resolved using OpenID Connect
+	// discovery.
+	discovery *oidcDiscovery
+}
+
+// issuerRegistry contains the token issuers trusted by the authorizer.
+type issuerRegistry struct {
+	// Trusted issuers, indexed by name.
+	issuers map[string]*trustedIssuer
+
+	// Union of the signing algorithms accepted across all issuers.
+	signingAlgorithms []string
+}
+
+// trustedIssuers is the registry of trusted token issuers.
+var trustedIssuers *issuerRegistry
+
+// newIssuerRegistry creates the registry of trusted issuers from the
+// specified issuer configuration.
+func newIssuerRegistry(configs []issuerConfig, settings jwksKeyStoreSettings,
+	discoveryInterval time.Duration) (*issuerRegistry, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("%w: no trusted issuers specified",
+			ErrInvalidIssuerConfig)
+	}
+
+	registry := &issuerRegistry{
+		issuers: make(map[string]*trustedIssuer, len(configs)),
+	}
+	for _, config := range configs {
+		if config.Issuer == "" ||
+			(config.JwksUrl != "" && config.IssuerUrl != "") ||
+			(config.JwksUrl == "" && config.IssuerUrl == "" &&
+				config.JwksFile == "" && config.PemDir == "") {
+			return nil, fmt.Errorf("%w: issuer %q must specify either a JWKS URL, an issuer URL or local signing keys",
+				ErrInvalidIssuerConfig, config.Issuer)
+		}
+		if _, ok := registry.issuers[config.Issuer]; ok {
+			return nil, fmt.Errorf("%w: issuer %q is specified more than once",
+				ErrInvalidIssuerConfig, config.Issuer)
+		}
+
+		tokenTypes := config.TokenTypes
+		if len(tokenTypes) == 0 {
+			tokenTypes = []string{TokenTypeDeviceAccessToken,
+				TokenTypeAppAccessToken}
+		}
+
+		signingAlgorithms := allowedSigningAlgorithms
+		if len(config.SigningAlgorithms) != 0 {
+			var err error
+			signingAlgorithms, err = parseSigningAlgorithms(config.SigningAlgorithms)
+			if err != nil {
+				return nil, fmt.Errorf("%w: issuer %q: %v",
+					ErrInvalidIssuerConfig, config.Issuer, err)
+			}
+		}
+
+		issuer := &trustedIssuer{
+			name:              config.Issuer,
+			tokenTypes:        tokenTypes,
+			signingAlgorithms: signingAlgorithms,
+		}
+		err := issuer.configureKeyProviders(config, settings, discoveryInterval)
+		if err != nil {
+			return nil, err
+		}
+		registry.issuers[config.Issuer] = issuer
+		for _, alg := range signingAlgorithms {
+			if !containsString(registry.signingAlgorithms, alg) {
+				registry.signingAlgorithms = append(registry.signingAlgorithms, alg)
+			}
+		}
+
+		iotLogger.Info("Added trusted token issuer.",
+			zap.String("Issuer:", config.Issuer),
+			zap.String("JWKS URL:", config.JwksUrl),
+			zap.String("Issuer URL:", config.IssuerUrl),
+			zap.String("JWKS file:", config.JwksFile),
+			zap.String("PEM directory:", config.PemDir),
+			zap.Bool("x5c pinning:", config.X5cRootCaFile != "" ||
+				settings.x5cRoots != nil),
+			zap.Strings("Token types:", tokenTypes),
+			zap.Strings("Signing algorithms:", signingAlgorithms),
+		)
+	}
+	return registry, nil
+}
+
+// configureKeyProviders creates the providers of the issuer's signing keys.
+func (i *trustedIssuer) configureKeyProviders(config issuerConfig,
+	settings jwksKeyStoreSettings, discoveryInterval time.Duration) error {
+	// Pin the JWKS signing keys to the issuer's root CAs, if configured.
+	if config.X5cRootCaFile != "" {
+		x5cRoots, err := loadCertPool(config.X5cRootCaFile)
+		if err != nil {
+			return fmt.Errorf("%w: issuer %q: %v", ErrInvalidIssuerConfig,
+				config.Issuer, err)
+		}
+		settings.x5cRoots = x5cRoots
+	}
+
+	var providers compositeKeyProvider
+	if config.JwksFile != "" {
+		provider, err := newJwksFileKeyProvider(config.JwksFile,
+			settings.x5cRoots)
+		if err != nil {
+			return fmt.Errorf("%w: issuer %q: %v", ErrInvalidIssuerConfig,
+				config.Issuer, err)
+		}
+		providers = append(providers, provider)
+	}
+
+	if config.PemDir != "" {
+		provider, err := newPemDirKeyProvider(config.PemDir, settings.x5cRoots)
+		if err != nil {
+			return fmt.Errorf("%w: issuer %q: %v", ErrInvalidIssuerConfig,
+				config.Issuer, err)
+		}
+		providers = append(providers, provider)
+	}
+
+	if config.IssuerUrl != "" {
+		var err error
+		i.discovery, err = newOidcDiscovery(config.Issuer, config.IssuerUrl,
+			discoveryInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.JwksUrl != "" || i.discovery != nil {
+		i.keyStore = newJwksKeyStore(config.Issuer, config.JwksUrl,
+			i.discovery, settings)
+		providers = append(providers, i.keyStore)
+	}
+
+	if len(providers) == 1 {
+		i.keyProvider = providers[0]
+	} else {
+		i.keyProvider = providers
+	}
+	return nil
+}
+
+// loadIssuerConfig loads the configuration of the trusted issuers. The
+// configuration is a JSON array of issuers, specified either inline or in a
+// file. If no issuers are configured, the DSTS issuer is trusted with the
+// specified default JWKS URL or issuer URL.
+func loadIssuerConfig(config string, configFile string, defaultJwksUrl string,
+	defaultIssuerUrl string) ([]issuerConfig, error) {
+	if configFile != "" {
+		configBytes, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidIssuerConfig, err)
+		}
+		config = string(configBytes)
+	}
+
+	if config == "" {
+		defaultConfig := issuerConfig{Issuer: dstsIssuerName}
+		if defaultIssuerUrl != "" {
+			defaultConfig.IssuerUrl = defaultIssuerUrl
+		} else {
+			defaultConfig.JwksUrl = defaultJwksUrl
+		}
+		return []issuerConfig{defaultConfig}, nil
+	}
+
+	var configs []issuerConfig
+	err := json.Unmarshal([]byte(config), &configs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIssuerConfig, err)
+	}
+	return configs, nil
+}
+
+// lookup returns the trusted issuer matching the 'iss' claim.
+func (r *issuerRegistry) lookup(name string) (*trustedIssuer, error) {
+	issuer, ok := r.issuers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidIssuerClaim, name)
+	}
+	return issuer, nil
+}
+
+// acceptsTokenType checks whether tokens of the specified type are accepted
+// from the issuer.
+func (i *trustedIssuer) acceptsTokenType(tokenType string) bool {
+	return containsString(i.tokenTypes, tokenType)
+}
+
+// acceptsSigningAlgorithm checks whether tokens from the issuer may be signed
+// using the specified algorithm. For issuers resolved using discovery, the
+// algorithm must also be advertised by the issuer.
+func (i *trustedIssuer) acceptsSigningAlgorithm(alg string) bool {
+	if !containsString(i.signingAlgorithms, alg) {
+		return false
+	}
+
+	if i.discovery != nil {
+		advertisedAlgorithms := i.discovery.signingAlgorithms()
+		if len(advertisedAlgorithms) != 0 {
+			return containsString(advertisedAlgorithms, alg)
+		}
+	}
+	return true
+}
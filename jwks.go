@@ -1,17 +1,19 @@
 package main
 
 import (
-	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"math"
 	"math/big"
-	"net/http"
 	"strings"
-	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 	"go.uber.org/zap"
@@ -22,22 +24,64 @@ const (
 	ktyRSA       = "RSA"
 	rsaPublicKey = "RSA PUBLIC KEY"
 
-	httpRequestTimeout = time.Second * 3
+	// ktyEC is the key type (kty) in the JWT header for elliptic curve keys.
+	ktyEC = "EC"
+
+	// ktyOKP is the key type (kty) in the JWT header for octet key pairs,
+	// used for EdDSA keys. See RFC 8037.
+	ktyOKP = "OKP"
+
+	// useSignature is the value of the use parameter for signing keys.
+	useSignature = "sig"
+
+	// Curves (crv) supported for EC and OKP keys.
+	crvP256    = "P-256"
+	crvP384    = "P-384"
+	crvP521    = "P-521"
+	crvEd25519 = "Ed25519"
 )
 
-var signingKeyTable map[string]*rsa.PublicKey
+var (
+	// Signing algorithms accepted for access tokens, unless overridden for a
+	// trusted issuer. Tokens signed using any other algorithm are rejected
+	// before their signature is verified.
+	allowedSigningAlgorithms = defaultSigningAlgorithms
+
+	defaultSigningAlgorithms = []string{
+		jwt.SigningMethodRS256.Alg(),
+		jwt.SigningMethodRS384.Alg(),
+		jwt.SigningMethodRS512.Alg(),
+		jwt.SigningMethodPS256.Alg(),
+	}
+)
 
 // jsonWebKey represents a JSON Web Key inside a JWKS.
 type jsonWebKey struct {
-	Curve    string `json:"crv"`
-	Exponent string `json:"e"`
-	K        string `json:"k"`
-	ID       string `json:"kid"`
-	Modulus  string `json:"n"`
-	Type     string `json:"kty"`
-	Use      string `json:"use"`
-	X        string `json:"x"`
-	Y        string `json:"y"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv"`
+	Exponent  string `json:"e"`
+	K         string `json:"k"`
+	ID        string `json:"kid"`
+	Modulus   string `json:"n"`
+	Type      string `json:"kty"`
+	Use       string `json:"use"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+
+	// Certificate chain and thumbprints of the key's certificate.
+	X5c     []string `json:"x5c"`
+	X5t     string   `json:"x5t"`
+	X5tS256 string   `json:"x5t#S256"`
+}
+
+// jwksSigningKey is a token signing key parsed from a JWKS.
+type jwksSigningKey struct {
+	// One of *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey.
+	publicKey crypto.PublicKey
+
+	// Signing algorithm the key is intended to be used with, if specified
+	// in the JWKS.
+	algorithm string
 }
 
 // rawJWKS represents a JWKS in JSON format.
@@ -51,102 +95,143 @@ func getSigningKey(token *jwt.Token) (interface{}, error) {
 		return nil, ErrInvalidTokenHeaderKid
 	}
 
-	// Check if a signing key corresponding to the kid was found in the
-	// signing key table.
-	pubKey, ok := signingKeyTable[kid]
+	// The token must only be verified using the signing keys of the issuer
+	// it claims to be issued by.
+	claims, ok := token.Claims.(*DstsTokenClaims)
 	if !ok {
-		// Key with this kid was not found - fetch the JWKS keys from the
-		// DSTS to check if this is a new signing key.
-		err := getJWKSSigningKey(dstsJwksUrl)
-		if err != nil {
-			iotLogger.Error("Failed to get JWKS signing keys from DSTS!")
-			return nil, err
-		}
-
-		pubKey, ok = signingKeyTable[kid]
-		if !ok {
-			return nil, fmt.Errorf("no public key to validate kid: %s", kid)
-		}
+		return nil, ErrInvalidToken
 	}
-
-	return pubKey, nil
-}
-
-func getJWKSSigningKey(url string) error {
-	var rawKS rawJWKS
-
-	// Fetch the
-	jwksBytes, err := getKeysFromServer(url)
+	issuer, err := trustedIssuers.lookup(claims.Issuer)
 	if err != nil {
-		iotLogger.Error("Error fetching keys.",
-			zap.String("url:", url),
-			zap.Error(err))
-		return err
+		return nil, err
+	}
+
+	if !issuer.acceptsSigningAlgorithm(token.Method.Alg()) {
+		return nil, fmt.Errorf("%w: %s is not allowed for issuer %q",
+			ErrDisallowedSigningAlg, token.Method.Alg(), issuer.name)
 	}
 
-	err = json.Unmarshal(jwksBytes, &rawKS)
+	// Look up the signing key corresponding to the kid from the issuer's
+	// signing key providers.
+	signingKey, err := issuer.keyProvider.getSigningKey(kid)
 	if err != nil {
-		iotLogger.Error("Failed to JSON unmarshal JWKS response!",
+		iotLogger.Error("Failed to get signing key for the issuer!",
+			zap.String("Issuer:", issuer.name),
+			zap.String("kid:", kid),
 			zap.Error(err),
 		)
-		return err
+		return nil, fmt.Errorf("no public key to validate kid: %s: %w", kid, err)
 	}
 
-	signingKeyTable = make(map[string]*rsa.PublicKey, len(rawKS.Keys))
-	for _, key := range rawKS.Keys {
-		switch keyType := key.Type; keyType {
-		case ktyRSA:
-			publicKey, err := parseRSASigningKey(key)
-			if err != nil {
-				iotLogger.Error("Error parsing signing key",
-					zap.String("type:", key.Type),
-					zap.String("kid:", key.ID),
-					zap.Error(err))
-				return err
-			}
+	// If the JWKS specifies the algorithm the key is to be used with, the
+	// token must have been signed using that algorithm.
+	if signingKey.algorithm != "" && signingKey.algorithm != token.Method.Alg() {
+		return nil, fmt.Errorf("%w: token specifies %s, key %s specifies %s",
+			ErrSigningKeyAlgMismatch, token.Method.Alg(), kid, signingKey.algorithm)
+	}
 
-			signingKeyTable[key.ID] = publicKey
+	return signingKey.publicKey, nil
+}
 
-		default:
+// parseSigningAlgorithms validates the configured list of allowed token
+// signing algorithms. Only asymmetric algorithms are supported, since tokens
+// are verified using public keys published by the DSTS.
+func parseSigningAlgorithms(algs []string) ([]string, error) {
+	if len(algs) == 0 {
+		return nil, fmt.Errorf("%w: no signing algorithms specified",
+			ErrInvalidTokenHeaderSigningAlg)
+	}
+
+	for _, alg := range algs {
+		switch jwt.GetSigningMethod(alg).(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS,
+			*jwt.SigningMethodECDSA, *jwt.SigningMethodEd25519:
 			continue
+		default:
+			return nil, fmt.Errorf("%w: unsupported signing algorithm: %s",
+				ErrInvalidTokenHeaderSigningAlg, alg)
 		}
 	}
-
-	return nil
+	return algs, nil
 }
 
-// Retrieve the token signing keys in JWKS format from the DSTS JWKS endpoint.
-func getKeysFromServer(keysUrl string) (keys []byte, err error) {
-	ctx, cancelFunc := context.WithTimeout(context.Background(), httpRequestTimeout)
-	defer cancelFunc()
+// parseJWKS parses the JWKS returned by the DSTS into a table of signing keys
+// indexed by kid. Keys that are not intended for signature verification are
+// ignored. Keys that cannot be parsed are skipped and reported, so that a
+// single malformed key does not prevent the other keys from being used. An
+// error is returned if the JWKS does not contain any usable signing keys.
+// If root CAs are specified, only keys certified by one of them are used.
+func parseJWKS(jwksBytes []byte,
+	x5cRoots *x509.CertPool) (map[string]*jwksSigningKey, error) {
+	var rawKS rawJWKS
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, keysUrl, nil)
+	err := json.Unmarshal(jwksBytes, &rawKS)
 	if err != nil {
-		iotLogger.Error("Failed to create HTTP request to the DSTS JWKS endpoint!",
-			zap.String("JWKS URL:", keysUrl),
+		iotLogger.Error("Failed to JSON unmarshal JWKS response!",
 			zap.Error(err),
 		)
 		return nil, err
 	}
 
-	req.Header.Set(headerUserAgent, authorizerUserAgent)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		iotLogger.Error("Failed to retrieve JWKS signing keys from DSTS!",
-			zap.String("JWKS URL:", keysUrl),
-			zap.Error(err),
-		)
-		return nil, err
+	keyTable := make(map[string]*jwksSigningKey, len(rawKS.Keys))
+	for _, key := range rawKS.Keys {
+		if key == nil {
+			continue
+		}
+
+		// The use parameter is optional. If specified, only keys intended for
+		// signature verification are used.
+		// https://tools.ietf.org/html/rfc7517#section-4.2
+		if key.Use != "" && key.Use != useSignature {
+			continue
+		}
+
+		var publicKey crypto.PublicKey
+		switch keyType := key.Type; keyType {
+		case ktyRSA:
+			publicKey, err = parseRSASigningKey(key)
+
+		case ktyEC:
+			publicKey, err = parseECSigningKey(key)
+
+		case ktyOKP:
+			publicKey, err = parseEdDSASigningKey(key)
+
+		default:
+			iotLogger.Warn("Skipping signing key of unsupported type.",
+				zap.String("type:", key.Type),
+				zap.String("kid:", key.ID))
+			continue
+		}
+		if err == nil && key.ID == "" {
+			err = ErrMissingKid
+		}
+		if err == nil && x5cRoots != nil {
+			err = verifyX5c(key, publicKey, x5cRoots)
+		}
+		if err == nil {
+			if _, ok := keyTable[key.ID]; ok {
+				err = ErrDuplicateKid
+			}
+		}
+		if err != nil {
+			iotLogger.Error("Skipping invalid signing key",
+				zap.String("type:", key.Type),
+				zap.String("kid:", key.ID),
+				zap.Error(err))
+			continue
+		}
+
+		keyTable[key.ID] = &jwksSigningKey{
+			publicKey: publicKey,
+			algorithm: key.Algorithm,
+		}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		iotLogger.Error("HTTP request to get JWKS signing keys failed!",
-			zap.String("JWKS URL:", keysUrl),
-			zap.Int("status", resp.StatusCode))
-		return nil, err
+	if len(keyTable) == 0 {
+		return nil, ErrNoSigningKeys
 	}
-	return io.ReadAll(resp.Body)
+	return keyTable, nil
 }
 
 // parseRSASigningKey parses a jsonWebKey and turns it into an RSA public key.
@@ -181,6 +266,84 @@ func parseRSASigningKey(j *jsonWebKey) (publicKey *rsa.PublicKey, err error) {
 	}, nil
 }
 
+// parseECSigningKey parses a jsonWebKey and turns it into an ECDSA public key.
+// The key must be on one of the NIST curves P-256, P-384 or P-521 and must
+// specify a point on the curve.
+// https://tools.ietf.org/html/rfc7518#section-6.2
+func parseECSigningKey(j *jsonWebKey) (publicKey *ecdsa.PublicKey, err error) {
+	if j.X == "" || j.Y == "" {
+		return nil, ErrMissingAssets
+	}
+
+	var curve elliptic.Curve
+	var ecdhCurve ecdh.Curve
+	switch j.Curve {
+	case crvP256:
+		curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+	case crvP384:
+		curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+	case crvP521:
+		curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedCurve, j.Curve)
+	}
+
+	x, err := base64urlTrailingPadding(j.X)
+	if err != nil {
+		return nil, err
+	}
+
+	y, err := base64urlTrailingPadding(j.Y)
+	if err != nil {
+		return nil, err
+	}
+
+	// The coordinates must be the full size of the curve's field elements.
+	// https://tools.ietf.org/html/rfc7518#section-6.2.1.2
+	byteLen := (curve.Params().BitSize + 7) / 8
+	if len(x) != byteLen || len(y) != byteLen {
+		return nil, ErrInvalidCurvePoint
+	}
+
+	// Ensure the point is on the curve by parsing its uncompressed encoding.
+	point := make([]byte, 0, 1+2*byteLen)
+	point = append(point, 4)
+	point = append(point, x...)
+	point = append(point, y...)
+	if _, err = ecdhCurve.NewPublicKey(point); err != nil {
+		return nil, ErrInvalidCurvePoint
+	}
+
+	return &ecdsa.PublicKey{
+		Curve: curve,
+		X:     big.NewInt(0).SetBytes(x),
+		Y:     big.NewInt(0).SetBytes(y),
+	}, nil
+}
+
+// parseEdDSASigningKey parses a jsonWebKey and turns it into an Ed25519
+// public key.
+// https://tools.ietf.org/html/rfc8037#section-2
+func parseEdDSASigningKey(j *jsonWebKey) (publicKey ed25519.PublicKey, err error) {
+	if j.X == "" {
+		return nil, ErrMissingAssets
+	}
+
+	if j.Curve != crvEd25519 {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedCurve, j.Curve)
+	}
+
+	x, err := base64urlTrailingPadding(j.X)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(x) != ed25519.PublicKeySize {
+		return nil, ErrInvalidCurvePoint
+	}
+	return ed25519.PublicKey(x), nil
+}
+
 // base64urlTrailingPadding removes trailing padding before decoding a string from base64url. Some non-RFC compliant
 // JWKS contain padding at the end values for base64url encoded public keys.
 //
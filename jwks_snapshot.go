@@ -0,0 +1,165 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Default maximum age of a persisted JWKS snapshot, or of the snapshot
+	// file, that may be used when the issuer's JWKS endpoint is unreachable
+	// at startup.
+	defaultJwksSnapshotMaxStaleness = time.Hour * 24
+
+	jwksSnapshotFilePrefix = "krypton-jwks-"
+)
+
+// bundledJwksSnapshots contains the JWKS snapshots bundled into the lambda
+// at build time. It is a JSON object mapping issuer names to their JWKS. To
+// bundle snapshots, replace jwks_snapshot.json before building the lambda.
+//
+//go:embed jwks_snapshot.json
+var bundledJwksSnapshots []byte
+
+// jwksSnapshotSettings specifies where JWKS snapshots are persisted and
+// loaded from.
+type jwksSnapshotSettings struct {
+	// Directory to which the last fetched JWKS of each issuer is persisted.
+	// In AWS Lambda, this directory survives restarts of the lambda within
+	// the same execution environment.
+	dir string
+
+	// Maximum age of a persisted JWKS snapshot, or of the snapshot file, that
+	// may be used.
+	maxStaleness time.Duration
+
+	// Path to a file containing JWKS snapshots in the same format as the
+	// bundled snapshots.
+	file string
+}
+
+// persistedJwksSnapshot is the JWKS last fetched from an issuer, as persisted
+// to the snapshot directory.
+type persistedJwksSnapshot struct {
+	Issuer    string          `json:"issuer"`
+	FetchedAt time.Time       `json:"fetched_at"`
+	JWKS      json.RawMessage `json:"jwks"`
+}
+
+// jwksSnapshots are the settings used by the JWKS key stores.
+var jwksSnapshots = jwksSnapshotSettings{
+	dir:          os.TempDir(),
+	maxStaleness: defaultJwksSnapshotMaxStaleness,
+}
+
+func (c jwksSnapshotSettings) persistedSnapshotPath(issuer string) string {
+	hash := sha256.Sum256([]byte(issuer))
+	return filepath.Join(c.dir,
+		jwksSnapshotFilePrefix+hex.EncodeToString(hash[:8])+".json")
+}
+
+// persist saves the JWKS fetched from the issuer to the snapshot directory.
+// The snapshot is written to a temporary file and renamed, so that a partial
+// snapshot is never read.
+func (c jwksSnapshotSettings) persist(issuer string, jwksBytes []byte) {
+	snapshotBytes, err := json.Marshal(persistedJwksSnapshot{
+		Issuer:    issuer,
+		FetchedAt: time.Now().UTC(),
+		JWKS:      jwksBytes,
+	})
+	if err == nil {
+		path := c.persistedSnapshotPath(issuer)
+		err = os.WriteFile(path+".tmp", snapshotBytes, 0600)
+		if err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		iotLogger.Warn("Failed to persist JWKS snapshot.",
+			zap.String("Issuer:", issuer),
+			zap.Error(err),
+		)
+	}
+}
+
+// load returns the most recent JWKS snapshot available for the issuer. The
+// JWKS persisted to the snapshot directory is preferred, followed by the
+// snapshot file, as long as they are not older than the maximum staleness.
+// The age of the snapshot file is determined by its modification time.
+// Otherwise, the snapshot bundled into the lambda is used. The bundled
+// snapshot is exempt from the maximum staleness, since its age cannot be
+// determined at runtime and it only changes when the lambda is rebuilt.
+func (c jwksSnapshotSettings) load(issuer string) ([]byte, string, error) {
+	path := c.persistedSnapshotPath(issuer)
+	snapshotBytes, err := os.ReadFile(path)
+	if err == nil {
+		var snapshot persistedJwksSnapshot
+		err = json.Unmarshal(snapshotBytes, &snapshot)
+		if err == nil && snapshot.Issuer == issuer &&
+			time.Since(snapshot.FetchedAt) <= c.maxStaleness {
+			return snapshot.JWKS, path, nil
+		}
+		iotLogger.Warn("Ignoring persisted JWKS snapshot that is invalid or stale.",
+			zap.String("Issuer:", issuer),
+			zap.String("Path:", path),
+			zap.Time("Fetched at:", snapshot.FetchedAt),
+		)
+	}
+
+	if c.file != "" {
+		fileInfo, err := os.Stat(c.file)
+		if err != nil {
+			return nil, "", err
+		}
+		if time.Since(fileInfo.ModTime()) <= c.maxStaleness {
+			snapshotBytes, err = os.ReadFile(c.file)
+			if err != nil {
+				return nil, "", err
+			}
+			jwksBytes, err := lookupJwksSnapshot(snapshotBytes, issuer)
+			if err == nil {
+				return jwksBytes, c.file, nil
+			}
+		} else {
+			iotLogger.Warn("Ignoring stale JWKS snapshot file.",
+				zap.String("Issuer:", issuer),
+				zap.String("Path:", c.file),
+				zap.Time("Modified at:", fileInfo.ModTime()),
+			)
+		}
+	}
+
+	jwksBytes, err := lookupJwksSnapshot(bundledJwksSnapshots, issuer)
+	if err != nil {
+		return nil, "", err
+	}
+	return jwksBytes, "bundled", nil
+}
+
+// lookupJwksSnapshot returns the JWKS of the issuer from a JSON object
+// mapping issuer names to their JWKS.
+func lookupJwksSnapshot(snapshotBytes []byte, issuer string) ([]byte, error) {
+	var snapshots map[string]json.RawMessage
+	err := json.Unmarshal(snapshotBytes, &snapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	jwksBytes, ok := snapshots[issuer]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNoJwksSnapshot, issuer)
+	}
+	return jwksBytes, nil
+}
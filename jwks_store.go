@@ -0,0 +1,431 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Default interval after which the JWKS signing keys are refreshed, if the
+	// DSTS does not specify caching directives in its response.
+	defaultJwksRefreshInterval = time.Hour
+
+	// Bounds applied to the cache lifetime of the JWKS signing keys. These
+	// protect against a DSTS that specifies a very short or very long cache
+	// lifetime in its response headers.
+	minJwksRefreshInterval = time.Minute
+	maxJwksRefreshInterval = time.Hour * 24
+
+	// Interval after which a failed refresh of the JWKS signing keys is
+	// retried. The last known good signing keys continue to be served until
+	// then.
+	jwksRefreshRetryInterval = time.Second * 30
+
+	// Default minimum interval between refetches of the JWKS triggered by
+	// tokens presenting an unknown kid.
+	defaultJwksMinRefetchInterval = time.Second * 30
+
+	// Default duration for which a kid that was not found in the JWKS is
+	// remembered. Tokens presenting such a kid are rejected without refetching
+	// the JWKS.
+	defaultJwksUnknownKidCacheTTL = time.Minute * 5
+
+	// Default deadline for refetches of the JWKS triggered by tokens
+	// presenting an unknown kid, including retries and rediscovery of the
+	// issuer's OpenID provider configuration. The connection request
+	// presenting the token waits for the refetch.
+	defaultJwksFetchDeadline = time.Second * 3
+
+	// Maximum number of unknown kids remembered by the negative cache.
+	maxJwksUnknownKidCacheSize = 10000
+
+	headerCacheControl = "Cache-Control"
+	headerExpires      = "Expires"
+	headerAge          = "Age"
+)
+
+// jwksKeyStoreSettings specifies the caching behavior of a jwksKeyStore.
+type jwksKeyStoreSettings struct {
+	// Interval after which the keys are refreshed, if the JWKS endpoint does
+	// not specify caching directives.
+	refreshInterval time.Duration
+
+	// Minimum interval between refetches of the JWKS triggered by tokens
+	// presenting an unknown kid.
+	minRefetchInterval time.Duration
+
+	// Duration for which an unknown kid is remembered.
+	unknownKidCacheTTL time.Duration
+
+	// Deadline for refetches of the JWKS triggered by tokens presenting an
+	// unknown kid.
+	fetchDeadline time.Duration
+
+	// If set, signing keys must specify a certificate chain (x5c) that
+	// validates up to one of these root CAs.
+	x5cRoots *x509.CertPool
+}
+
+// jwksRefreshCall represents an in-flight refresh of the JWKS signing keys.
+// Concurrent callers requesting a refresh wait for the in-flight refresh to
+// complete instead of issuing their own request to the JWKS endpoint.
+type jwksRefreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+// jwksKeyStore caches the token signing keys retrieved from a JWKS endpoint.
+// It is safe for concurrent use. Once the cached keys expire, they are
+// refreshed in the background while the last known good keys continue to be
+// served to callers.
+type jwksKeyStore struct {
+	// Name of the issuer publishing the signing keys.
+	issuer string
+
+	// URL of the JWKS endpoint.
+	url string
+
+	// If set, the URL of the JWKS endpoint is resolved using OpenID Connect
+	// discovery instead.
+	discovery *oidcDiscovery
+
+	settings jwksKeyStoreSettings
+
+	// Protects the fields below.
+	lock sync.RWMutex
+
+	// Signing keys indexed by kid.
+	keys map[string]*jwksSigningKey
+
+	// Time at which the cached signing keys must be refreshed.
+	expiresAt time.Time
+
+	// Set while a refresh of the signing keys is in progress.
+	inflight *jwksRefreshCall
+
+	// Time at which the signing keys were last requested from the JWKS
+	// endpoint.
+	lastRefreshAt time.Time
+
+	// Negative cache of kids that were not found in the JWKS, along with the
+	// time at which they were looked up.
+	unknownKids map[string]time.Time
+}
+
+func newJwksKeyStore(issuer string, url string, discovery *oidcDiscovery,
+	settings jwksKeyStoreSettings) *jwksKeyStore {
+	return &jwksKeyStore{
+		issuer:      issuer,
+		url:         url,
+		discovery:   discovery,
+		settings:    settings,
+		keys:        map[string]*jwksSigningKey{},
+		unknownKids: map[string]time.Time{},
+	}
+}
+
+// getKey returns the signing key with the specified kid. If the cached keys
+// have expired, a background refresh is triggered and the currently cached
+// keys are used to service this request.
+func (s *jwksKeyStore) getKey(kid string) (*jwksSigningKey, bool) {
+	s.lock.RLock()
+	signingKey, ok := s.keys[kid]
+	expired := time.Now().After(s.expiresAt)
+	s.lock.RUnlock()
+
+	if expired {
+		s.refreshInBackground()
+	}
+	return signingKey, ok
+}
+
+// getSigningKey returns the signing key with the specified kid from the
+// issuer's JWKS endpoint, refetching the JWKS if the kid is unknown.
+func (s *jwksKeyStore) getSigningKey(kid string) (*jwksSigningKey, error) {
+	signingKey, ok := s.getKey(kid)
+	if ok {
+		return signingKey, nil
+	}
+
+	// Key with this kid was not found - fetch the JWKS keys from the issuer
+	// to check if this is a new signing key.
+	return s.getUnknownKey(kid)
+}
+
+// getUnknownKey is invoked when a token presents a kid that is not among the
+// cached signing keys. The JWKS is refetched to check whether the DSTS has
+// published a new signing key. To protect the JWKS endpoint from tokens with
+// forged kids, refetches are rate limited and kids that were recently found
+// to be unknown are rejected without refetching the JWKS.
+func (s *jwksKeyStore) getUnknownKey(kid string) (*jwksSigningKey, error) {
+	now := time.Now()
+
+	s.lock.Lock()
+	lookedUpAt, ok := s.unknownKids[kid]
+	if ok && now.Sub(lookedUpAt) < s.settings.unknownKidCacheTTL {
+		s.lock.Unlock()
+		return nil, ErrUnknownSigningKey
+	}
+
+	// Join an in-flight refresh if there is one. Otherwise, ensure that the
+	// JWKS endpoint is not refetched more often than allowed.
+	if s.inflight == nil &&
+		now.Sub(s.lastRefreshAt) < s.settings.minRefetchInterval {
+		s.lock.Unlock()
+		iotLogger.Debug("Rate limited refetch of JWKS signing keys for unknown kid.",
+			zap.String("kid:", kid),
+		)
+		return nil, ErrUnknownSigningKey
+	}
+	s.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		s.settings.fetchDeadline)
+	defer cancel()
+	err := s.refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	signingKey, ok := s.keys[kid]
+	if !ok {
+		s.addUnknownKid(kid, time.Now())
+		return nil, ErrUnknownSigningKey
+	}
+	return signingKey, nil
+}
+
+// addUnknownKid adds the kid to the negative cache. The caller must hold the
+// lock.
+func (s *jwksKeyStore) addUnknownKid(kid string, lookedUpAt time.Time) {
+	if len(s.unknownKids) >= maxJwksUnknownKidCacheSize {
+		// Evict expired entries. If the cache is still full, it is being
+		// flooded with forged kids - start afresh.
+		for unknownKid, t := range s.unknownKids {
+			if lookedUpAt.Sub(t) >= s.settings.unknownKidCacheTTL {
+				delete(s.unknownKids, unknownKid)
+			}
+		}
+		if len(s.unknownKids) >= maxJwksUnknownKidCacheSize {
+			s.unknownKids = map[string]time.Time{}
+		}
+	}
+	s.unknownKids[kid] = lookedUpAt
+}
+
+// refreshInBackground starts a refresh of the signing keys, unless one is
+// already in progress.
+func (s *jwksKeyStore) refreshInBackground() {
+	s.lock.RLock()
+	inflight := s.inflight != nil
+	s.lock.RUnlock()
+	if inflight {
+		return
+	}
+
+	go func() {
+		err := s.refresh(context.Background())
+		if err != nil {
+			iotLogger.Error("Background refresh of JWKS signing keys failed. Continuing with cached keys!",
+				zap.Error(err),
+			)
+		}
+	}()
+}
+
+// refresh retrieves the signing keys from the JWKS endpoint and replaces the
+// cached keys with them. If a refresh is already in progress, the caller
+// waits for it to complete and shares its result, unless the deadline of the
+// context passes first.
+func (s *jwksKeyStore) refresh(ctx context.Context) error {
+	s.lock.Lock()
+	if call := s.inflight; call != nil {
+		s.lock.Unlock()
+		select {
+		case <-call.done:
+			return call.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	call := &jwksRefreshCall{done: make(chan struct{})}
+	s.inflight = call
+	s.lastRefreshAt = time.Now()
+	s.lock.Unlock()
+
+	call.err = s.fetch(ctx)
+
+	s.lock.Lock()
+	s.inflight = nil
+	s.lock.Unlock()
+	close(call.done)
+	return call.err
+}
+
+// fetch retrieves the signing keys from the JWKS endpoint. If the keys could
+// not be retrieved, the cached keys are retained and the refresh is retried
+// after a short interval.
+func (s *jwksKeyStore) fetch(ctx context.Context) error {
+	jwksUrl := s.url
+	if s.discovery != nil {
+		metadata, err := s.discovery.getMetadata(ctx)
+		if err != nil {
+			s.retryLater()
+			return err
+		}
+		jwksUrl = metadata.JwksUri
+	}
+
+	jwksBytes, header, err := getFromServer(ctx, jwksUrl)
+	if err != nil {
+		iotLogger.Error("Error fetching keys.",
+			zap.String("url:", jwksUrl),
+			zap.Error(err))
+		s.retryLater()
+		return err
+	}
+
+	keys, err := parseJWKS(jwksBytes, s.settings.x5cRoots)
+	if err != nil {
+		s.retryLater()
+		return err
+	}
+
+	lifetime := jwksCacheLifetime(header, s.settings.refreshInterval)
+
+	s.lock.Lock()
+	previousKeys := s.keys
+	s.keys = keys
+	s.expiresAt = time.Now().Add(lifetime)
+	s.lock.Unlock()
+
+	logKeyRotation(jwksUrl, previousKeys, keys)
+	jwksSnapshots.persist(s.issuer, jwksBytes)
+
+	iotLogger.Debug("Refreshed JWKS signing keys.",
+		zap.String("JWKS URL:", jwksUrl),
+		zap.Int("Key count:", len(keys)),
+		zap.Duration("Cache lifetime:", lifetime),
+	)
+	return nil
+}
+
+// loadSnapshot loads the signing keys from the last known good JWKS snapshot
+// of the issuer. It is used when the JWKS endpoint is unreachable at startup.
+// The keys are refreshed from the JWKS endpoint once it becomes reachable.
+func (s *jwksKeyStore) loadSnapshot() error {
+	jwksBytes, source, err := jwksSnapshots.load(s.issuer)
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(jwksBytes, s.settings.x5cRoots)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.keys = keys
+	s.lock.Unlock()
+
+	iotLogger.Warn("Loaded JWKS signing keys from snapshot.",
+		zap.String("Issuer:", s.issuer),
+		zap.String("Source:", source),
+		zap.Int("Key count:", len(keys)),
+	)
+	return nil
+}
+
+func (s *jwksKeyStore) retryLater() {
+	s.lock.Lock()
+	s.expiresAt = time.Now().Add(jwksRefreshRetryInterval)
+	s.lock.Unlock()
+}
+
+// jwksCacheLifetime determines how long the signing keys may be cached based
+// on the Cache-Control and Expires headers returned by the JWKS endpoint. As
+// per RFC 9111, the max-age directive takes precedence over the Expires
+// header. If neither is specified, the configured refresh interval is used.
+func jwksCacheLifetime(header http.Header, refreshInterval time.Duration) time.Duration {
+	for _, directive := range strings.Split(header.Get(headerCacheControl), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			return minJwksRefreshInterval
+
+		case strings.HasPrefix(directive, "max-age="):
+			maxAge, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil {
+				continue
+			}
+
+			// Account for the time the response spent in intermediate caches.
+			age, err := strconv.Atoi(header.Get(headerAge))
+			if err == nil && age > 0 {
+				maxAge -= age
+			}
+			return clampJwksRefreshInterval(time.Duration(maxAge) * time.Second)
+		}
+	}
+
+	if expires := header.Get(headerExpires); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err == nil {
+			return clampJwksRefreshInterval(time.Until(expiresAt))
+		}
+	}
+
+	return refreshInterval
+}
+
+func clampJwksRefreshInterval(interval time.Duration) time.Duration {
+	if interval < minJwksRefreshInterval {
+		return minJwksRefreshInterval
+	}
+	if interval > maxJwksRefreshInterval {
+		return maxJwksRefreshInterval
+	}
+	return interval
+}
+
+// logKeyRotation logs the kids of the signing keys that were added and removed
+// when the signing keys were refreshed.
+func logKeyRotation(jwksUrl string, previousKeys map[string]*jwksSigningKey,
+	keys map[string]*jwksSigningKey) {
+	var addedKids, removedKids []string
+	for kid := range keys {
+		if _, ok := previousKeys[kid]; !ok {
+			addedKids = append(addedKids, kid)
+		}
+	}
+	for kid := range previousKeys {
+		if _, ok := keys[kid]; !ok {
+			removedKids = append(removedKids, kid)
+		}
+	}
+
+	if len(addedKids) == 0 && len(removedKids) == 0 {
+		return
+	}
+	sort.Strings(addedKids)
+	sort.Strings(removedKids)
+	iotLogger.Info("JWKS signing keys rotated.",
+		zap.String("JWKS URL:", jwksUrl),
+		zap.Strings("Added kids:", addedKids),
+		zap.Strings("Removed kids:", removedKids),
+	)
+}
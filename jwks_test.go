@@ -0,0 +1,317 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// encodeTestCoordinate encodes the coordinate of an EC public key, padded to
+// the size of the field elements of the curve.
+func encodeTestCoordinate(curve elliptic.Curve, value *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(
+		value.FillBytes(make([]byte, (curve.Params().BitSize+7)/8)))
+}
+
+// newTestECKey generates an EC key on the curve, and returns it with its JWK.
+func newTestECKey(t *testing.T, curve elliptic.Curve,
+	crv string) (*ecdsa.PrivateKey, *jsonWebKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate EC key: %v", err)
+	}
+	return key, &jsonWebKey{
+		ID:    "key1",
+		Type:  ktyEC,
+		Use:   useSignature,
+		Curve: crv,
+		X:     encodeTestCoordinate(curve, key.X),
+		Y:     encodeTestCoordinate(curve, key.Y),
+	}
+}
+
+// newTestEd25519Key generates an Ed25519 key, and returns it with its JWK.
+func newTestEd25519Key(t *testing.T) (ed25519.PrivateKey, *jsonWebKey) {
+	t.Helper()
+	publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate Ed25519 key: %v", err)
+	}
+	return key, &jsonWebKey{
+		ID:    "key1",
+		Type:  ktyOKP,
+		Use:   useSignature,
+		Curve: crvEd25519,
+		X:     base64.RawURLEncoding.EncodeToString(publicKey),
+	}
+}
+
+// marshalTestJWKS returns a JWKS containing the keys.
+func marshalTestJWKS(t *testing.T, keys ...*jsonWebKey) []byte {
+	t.Helper()
+	jwksBytes, err := json.Marshal(&rawJWKS{Keys: keys})
+	if err != nil {
+		t.Fatalf("failed to marshal JWKS: %v", err)
+	}
+	return jwksBytes
+}
+
+// writeTestJwksFile writes a JWKS containing the keys to a file, and returns
+// the path of the file.
+func writeTestJwksFile(t *testing.T, keys ...*jsonWebKey) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	err := os.WriteFile(path, marshalTestJWKS(t, keys...), 0600)
+	if err != nil {
+		t.Fatalf("failed to write JWKS file: %v", err)
+	}
+	return path
+}
+
+func TestECAndEdDSASigningKeys(t *testing.T) {
+	initLogger()
+	p256Key, p256JWK := newTestECKey(t, elliptic.P256(), crvP256)
+	p384Key, p384JWK := newTestECKey(t, elliptic.P384(), crvP384)
+	ed25519Key, ed25519JWK := newTestEd25519Key(t)
+
+	tests := []struct {
+		name   string
+		method jwt.SigningMethod
+		key    crypto.Signer
+		jwk    *jsonWebKey
+	}{
+		{"P-256", jwt.SigningMethodES256, p256Key, p256JWK},
+		{"P-384", jwt.SigningMethodES384, p384Key, p384JWK},
+		{"Ed25519", jwt.SigningMethodEdDSA, ed25519Key, ed25519JWK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jwksFile := writeTestJwksFile(t, tt.jwk)
+			token := signTestToken(t, tt.method, newTestToken(), tt.key)
+
+			// EC and EdDSA signatures are only accepted if they are allowed
+			// for the issuer.
+			setTrustedIssuers(t, issuerConfig{
+				Issuer:   "test-issuer",
+				JwksFile: jwksFile,
+			})
+			_, err := validateDstsAccessToken(token)
+			if !errors.Is(err, ErrDisallowedSigningAlg) {
+				t.Errorf("expected ErrDisallowedSigningAlg, got %v", err)
+			}
+
+			setTrustedIssuers(t, issuerConfig{
+				Issuer:            "test-issuer",
+				JwksFile:          jwksFile,
+				SigningAlgorithms: []string{tt.method.Alg()},
+			})
+			_, err = validateDstsAccessToken(token)
+			if err != nil {
+				t.Errorf("failed to validate the token: %v", err)
+			}
+		})
+	}
+}
+
+func TestInvalidECAndEdDSASigningKeys(t *testing.T) {
+	key, validJWK := newTestECKey(t, elliptic.P256(), crvP256)
+
+	offCurveJWK := *validJWK
+	offCurveJWK.Y = encodeTestCoordinate(elliptic.P256(),
+		new(big.Int).Add(key.Y, big.NewInt(1)))
+
+	shortJWK := *validJWK
+	shortJWK.X = base64.RawURLEncoding.EncodeToString(key.X.Bytes()[1:])
+
+	unsupportedCurveJWK := *validJWK
+	unsupportedCurveJWK.Curve = "P-192"
+
+	for name, tt := range map[string]struct {
+		jwk     *jsonWebKey
+		wantErr error
+	}{
+		"off curve":         {&offCurveJWK, ErrInvalidCurvePoint},
+		"wrong length":      {&shortJWK, ErrInvalidCurvePoint},
+		"unsupported curve": {&unsupportedCurveJWK, ErrUnsupportedCurve},
+	} {
+		_, err := parseECSigningKey(tt.jwk)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("EC %s: expected error %v, got %v", name, tt.wantErr, err)
+		}
+	}
+
+	_, validEdJWK := newTestEd25519Key(t)
+
+	shortEdJWK := *validEdJWK
+	shortEdJWK.X = base64.RawURLEncoding.EncodeToString(make([]byte, 31))
+
+	x25519JWK := *validEdJWK
+	x25519JWK.Curve = "X25519"
+
+	for name, tt := range map[string]struct {
+		jwk     *jsonWebKey
+		wantErr error
+	}{
+		"wrong length":      {&shortEdJWK, ErrInvalidCurvePoint},
+		"unsupported curve": {&x25519JWK, ErrUnsupportedCurve},
+	} {
+		_, err := parseEdDSASigningKey(tt.jwk)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("OKP %s: expected error %v, got %v", name, tt.wantErr, err)
+		}
+	}
+}
+
+// assertRSAKey checks that the signing key is the public key of the key.
+func assertRSAKey(t *testing.T, signingKey *jwksSigningKey, want *rsa.PrivateKey) {
+	t.Helper()
+	publicKey, ok := signingKey.publicKey.(*rsa.PublicKey)
+	if !ok || !publicKey.Equal(&want.PublicKey) {
+		t.Errorf("unexpected signing key")
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	initLogger()
+	key := newTestRSAKey(t)
+	otherKey := newTestRSAKey(t)
+
+	malformed := newTestRSAJWK("malformed", key)
+	malformed.Modulus = "not base64url!"
+
+	encryption := newTestRSAJWK("encryption", key)
+	encryption.Use = "enc"
+
+	noKid := newTestRSAJWK("", key)
+
+	unsupported := newTestRSAJWK("unsupported", key)
+	unsupported.Type = "oct"
+
+	keys, err := parseJWKS(marshalTestJWKS(t,
+		newTestRSAJWK("key1", key),
+		malformed,
+		encryption,
+		noKid,
+		unsupported,
+		newTestRSAJWK("key1", otherKey),
+		newTestRSAJWK("key2", otherKey),
+	), nil)
+	if err != nil {
+		t.Fatalf("failed to parse JWKS: %v", err)
+	}
+
+	// Invalid keys, keys that are not signing keys and keys whose kid is
+	// already used are skipped.
+	if len(keys) != 2 || keys["key1"] == nil || keys["key2"] == nil {
+		t.Fatalf("unexpected signing keys: %v", keys)
+	}
+	assertRSAKey(t, keys["key1"], key)
+	assertRSAKey(t, keys["key2"], otherKey)
+
+	_, err = parseJWKS(marshalTestJWKS(t, malformed, encryption, noKid), nil)
+	if !errors.Is(err, ErrNoSigningKeys) {
+		t.Errorf("expected ErrNoSigningKeys, got %v", err)
+	}
+}
+
+func TestJwksStoreRetainsKeysOnInvalidJWKS(t *testing.T) {
+	initLogger()
+	jwksSnapshots.dir = t.TempDir()
+	t.Cleanup(func() {
+		jwksSnapshots.dir = os.TempDir()
+	})
+
+	key := newTestRSAKey(t)
+	malformed := newTestRSAJWK("key2", key)
+	malformed.Exponent = ""
+
+	var jwksBytes atomic.Value
+	jwksBytes.Store(marshalTestJWKS(t, newTestRSAJWK("key1", key)))
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(headerContentType, contentTypeJson)
+			_, _ = w.Write(jwksBytes.Load().([]byte))
+		}))
+	t.Cleanup(server.Close)
+
+	registry, err := newIssuerRegistry([]issuerConfig{{
+		Issuer:  "test-issuer",
+		JwksUrl: server.URL,
+	}}, testKeyStoreSettings(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create issuer registry: %v", err)
+	}
+	store := registry.issuers["test-issuer"].keyStore
+
+	err = store.refresh(context.Background())
+	if err != nil {
+		t.Fatalf("failed to refresh signing keys: %v", err)
+	}
+
+	// A JWKS without valid signing keys doesn't replace the cached keys.
+	jwksBytes.Store(marshalTestJWKS(t, malformed))
+	err = store.refresh(context.Background())
+	if !errors.Is(err, ErrNoSigningKeys) {
+		t.Errorf("expected ErrNoSigningKeys, got %v", err)
+	}
+	signingKey, ok := store.getKey("key1")
+	if !ok {
+		t.Fatalf("cached signing key discarded")
+	}
+	assertRSAKey(t, signingKey, key)
+}
+
+func TestJwksSnapshotFileStaleness(t *testing.T) {
+	initLogger()
+	jwksBytes := marshalTestJWKS(t, newTestRSAJWK("key1", newTestRSAKey(t)))
+	path := filepath.Join(t.TempDir(), "snapshots.json")
+	err := os.WriteFile(path, []byte(`{"test-issuer":`+string(jwksBytes)+`}`),
+		0600)
+	if err != nil {
+		t.Fatalf("failed to write the snapshot file: %v", err)
+	}
+	snapshots := jwksSnapshotSettings{
+		dir:          t.TempDir(),
+		maxStaleness: time.Hour,
+		file:         path,
+	}
+
+	// The snapshot file is used if it was modified recently.
+	_, source, err := snapshots.load("test-issuer")
+	if err != nil || source != path {
+		t.Errorf("expected the snapshot file to be used, got %q: %v", source, err)
+	}
+
+	// Stale snapshot files are ignored.
+	modTime := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.Fatalf("failed to set the modification time: %v", err)
+	}
+	_, _, err = snapshots.load("test-issuer")
+	if !errors.Is(err, ErrNoJwksSnapshot) {
+		t.Errorf("expected ErrNoJwksSnapshot, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"crypto"
+	"crypto/sha1" // #nosec G505 - x5t thumbprints are defined as SHA-1 digests by RFC 7517.
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+)
+
+// loadCertPool loads the PEM encoded CA certificates in the specified file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	caBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// verifyX5c verifies that the signing key is certified by one of the pinned
+// root CAs. The key must specify a certificate chain (x5c) that validates up
+// to a pinned root CA, and the public key of the leaf certificate must match
+// the key. If the key specifies certificate thumbprints (x5t, x5t#S256), they
+// must match the leaf certificate.
+// https://tools.ietf.org/html/rfc7517#section-4.7
+func verifyX5c(j *jsonWebKey, publicKey crypto.PublicKey,
+	roots *x509.CertPool) error {
+	if len(j.X5c) == 0 {
+		return ErrMissingX5c
+	}
+
+	// Certificates in the chain are base64 (not base64url) encoded DER.
+	certs := make([]*x509.Certificate, 0, len(j.X5c))
+	for _, encodedCert := range j.X5c {
+		der, err := base64.StdEncoding.DecodeString(encodedCert)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidX5c, err)
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidX5c, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	leaf := certs[0]
+	err := verifyCertChain(certs, roots)
+	if err != nil {
+		return err
+	}
+
+	key, ok := publicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !key.Equal(leaf.PublicKey) {
+		return ErrX5cKeyMismatch
+	}
+
+	if j.X5t != "" {
+		thumbprint := sha1.Sum(leaf.Raw) // #nosec G401
+		if !thumbprintMatches(j.X5t, thumbprint[:]) {
+			return fmt.Errorf("%w: x5t", ErrX5cThumbprintMismatch)
+		}
+	}
+
+	if j.X5tS256 != "" {
+		thumbprint := sha256.Sum256(leaf.Raw)
+		if !thumbprintMatches(j.X5tS256, thumbprint[:]) {
+			return fmt.Errorf("%w: x5t#S256", ErrX5cThumbprintMismatch)
+		}
+	}
+	return nil
+}
+
+// verifyCertChain verifies that the first certificate of the chain validates
+// up to one of the root CAs, using the other certificates of the chain as
+// intermediates.
+func verifyCertChain(certs []*x509.Certificate, roots *x509.CertPool) error {
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidX5c, err)
+	}
+	return nil
+}
+
+// thumbprintMatches checks whether the base64url encoded thumbprint matches
+// the specified digest.
+func thumbprintMatches(encodedThumbprint string, digest []byte) bool {
+	thumbprint, err := base64urlTrailingPadding(encodedThumbprint)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(thumbprint, digest) == 1
+}
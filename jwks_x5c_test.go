@@ -0,0 +1,183 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing test certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA creates a self-signed root CA.
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %v", err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// pool returns a certificate pool containing the CA.
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns the DER encoded certificate issued by the CA for the public
+// key.
+func (ca *testCA) issue(t *testing.T, publicKey crypto.PublicKey) []byte {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "signing key"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert,
+		publicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	return der
+}
+
+func TestVerifyX5c(t *testing.T) {
+	initLogger()
+	rootCA := newTestCA(t, "root")
+	otherCA := newTestCA(t, "other")
+	key := newTestRSAKey(t)
+	otherKey := newTestRSAKey(t)
+
+	certified := newTestRSAJWK("key1", key)
+	certified.X5c = []string{
+		base64.StdEncoding.EncodeToString(rootCA.issue(t, &key.PublicKey)),
+	}
+
+	otherRoot := newTestRSAJWK("key1", key)
+	otherRoot.X5c = []string{
+		base64.StdEncoding.EncodeToString(otherCA.issue(t, &key.PublicKey)),
+	}
+
+	keyMismatch := newTestRSAJWK("key1", key)
+	keyMismatch.X5c = []string{
+		base64.StdEncoding.EncodeToString(rootCA.issue(t, &otherKey.PublicKey)),
+	}
+
+	tests := []struct {
+		name    string
+		jwk     *jsonWebKey
+		wantErr error
+	}{
+		{"certified", certified, nil},
+		{"no x5c", newTestRSAJWK("key1", key), ErrMissingX5c},
+		{"not chaining to the roots", otherRoot, ErrInvalidX5c},
+		{"leaf key does not match", keyMismatch, ErrX5cKeyMismatch},
+	}
+	for _, tt := range tests {
+		keys, err := parseJWKS(marshalTestJWKS(t, tt.jwk), rootCA.pool())
+		if tt.wantErr == nil {
+			if err != nil || keys["key1"] == nil {
+				t.Errorf("%s: expected the key to be accepted, got %v", tt.name, err)
+			}
+			continue
+		}
+
+		// Keys that fail the checks are skipped.
+		if !errors.Is(err, ErrNoSigningKeys) {
+			t.Errorf("%s: expected ErrNoSigningKeys, got %v", tt.name, err)
+		}
+		publicKey, err := parseRSASigningKey(tt.jwk)
+		if err != nil {
+			t.Fatalf("%s: failed to parse key: %v", tt.name, err)
+		}
+		err = verifyX5c(tt.jwk, publicKey, rootCA.pool())
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
+
+func TestPemDirX5cRoots(t *testing.T) {
+	initLogger()
+	rootCA := newTestCA(t, "root")
+	otherCA := newTestCA(t, "other")
+	key := newTestRSAKey(t)
+
+	writePem := func(dir string, blockType string, der []byte) {
+		pemBytes := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+		err := os.WriteFile(filepath.Join(dir, "key1.pem"), pemBytes, 0600)
+		if err != nil {
+			t.Fatalf("failed to write PEM file: %v", err)
+		}
+	}
+
+	// Certificates issued by the roots are accepted.
+	dir := t.TempDir()
+	writePem(dir, pemCertificate, rootCA.issue(t, &key.PublicKey))
+	provider, err := newPemDirKeyProvider(dir, rootCA.pool())
+	if err != nil {
+		t.Fatalf("failed to load the PEM directory: %v", err)
+	}
+	assertSigningKey(t, provider, "key1", key)
+
+	// Certificates issued by other CAs, and bare public keys, are rejected.
+	dir = t.TempDir()
+	writePem(dir, pemCertificate, otherCA.issue(t, &key.PublicKey))
+	_, err = newPemDirKeyProvider(dir, rootCA.pool())
+	if !errors.Is(err, ErrInvalidX5c) {
+		t.Errorf("expected ErrInvalidX5c, got %v", err)
+	}
+
+	dir = t.TempDir()
+	writeTestPemKey(t, filepath.Join(dir, "key1.pem"), key)
+	_, err = newPemDirKeyProvider(dir, rootCA.pool())
+	if !errors.Is(err, ErrMissingX5c) {
+		t.Errorf("expected ErrMissingX5c, got %v", err)
+	}
+
+	// Bare public keys are accepted if no roots are configured.
+	_, err = newPemDirKeyProvider(dir, nil)
+	if err != nil {
+		t.Errorf("failed to load the PEM directory: %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	pemPublicKey   = "PUBLIC KEY"
+	pemCertificate = "CERTIFICATE"
+	pemFileSuffix  = ".pem"
+)
+
+// keyProvider provides the signing keys used to verify tokens from an
+// issuer.
+type keyProvider interface {
+	// getSigningKey returns the signing key with the specified kid. If the
+	// provider has no such key, ErrUnknownSigningKey is returned.
+	getSigningKey(kid string) (*jwksSigningKey, error)
+}
+
+// staticKeyProvider provides signing keys loaded from local files at
+// startup. It is used in air-gapped environments and for offline testing.
+type staticKeyProvider struct {
+	// Signing keys indexed by kid.
+	keys map[string]*jwksSigningKey
+}
+
+func (p *staticKeyProvider) getSigningKey(kid string) (*jwksSigningKey, error) {
+	signingKey, ok := p.keys[kid]
+	if !ok {
+		return nil, ErrUnknownSigningKey
+	}
+	return signingKey, nil
+}
+
+// newJwksFileKeyProvider loads the signing keys from a local JWKS file. If
+// root CAs are specified, only keys certified by one of them are loaded.
+func newJwksFileKeyProvider(path string,
+	x5cRoots *x509.CertPool) (*staticKeyProvider, error) {
+	jwksBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := parseJWKS(jwksBytes, x5cRoots)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	iotLogger.Info("Loaded signing keys from JWKS file.",
+		zap.String("Path:", path),
+		zap.Int("Key count:", len(keys)),
+	)
+	return &staticKeyProvider{keys: keys}, nil
+}
+
+// newPemDirKeyProvider loads the signing keys from a directory of PEM
+// encoded public keys or certificates. Each file is named after the kid of
+// the key it contains, eg: the key with kid 'key1' is in 'key1.pem'. If root
+// CAs are specified, each file must contain a certificate, optionally followed
+// by its intermediate certificates, that validates up to one of them.
+func newPemDirKeyProvider(dir string,
+	x5cRoots *x509.CertPool) (*staticKeyProvider, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+pemFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*jwksSigningKey, len(paths))
+	for _, path := range paths {
+		publicKey, err := parsePemSigningKey(path, x5cRoots)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		kid := strings.TrimSuffix(filepath.Base(path), pemFileSuffix)
+		keys[kid] = &jwksSigningKey{publicKey: publicKey}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: %w", dir, ErrNoSigningKeys)
+	}
+
+	iotLogger.Info("Loaded signing keys from PEM directory.",
+		zap.String("Directory:", dir),
+		zap.Int("Key count:", len(keys)),
+	)
+	return &staticKeyProvider{keys: keys}, nil
+}
+
+// parsePemSigningKey parses a PEM encoded RSA, ECDSA or Ed25519 public key,
+// or the public key of a PEM encoded certificate. If root CAs are specified,
+// only certificates that validate up to one of them are accepted.
+func parsePemSigningKey(path string,
+	x5cRoots *x509.CertPool) (crypto.PublicKey, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, rest := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, ErrInvalidPemKey
+	}
+	if x5cRoots != nil {
+		if block.Type != pemCertificate {
+			return nil, ErrMissingX5c
+		}
+		err = verifyPemCertChain(block, rest, x5cRoots)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var publicKey crypto.PublicKey
+	switch block.Type {
+	case rsaPublicKey:
+		publicKey, err = x509.ParsePKCS1PublicKey(block.Bytes)
+
+	case pemPublicKey:
+		publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+
+	case pemCertificate:
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			publicKey = cert.PublicKey
+		}
+
+	default:
+		return nil, fmt.Errorf("%w: unsupported PEM block type: %s",
+			ErrInvalidPemKey, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPemKey, err)
+	}
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+			return key, nil
+		}
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedCurve,
+			key.Curve.Params().Name)
+
+	default:
+		return nil, fmt.Errorf("%w: unsupported public key type: %T",
+			ErrInvalidPemKey, publicKey)
+	}
+}
+
+// verifyPemCertChain verifies that the PEM encoded certificate validates up
+// to one of the root CAs, using the certificates in the rest of the file as
+// intermediates.
+func verifyPemCertChain(block *pem.Block, rest []byte,
+	roots *x509.CertPool) error {
+	var certs []*x509.Certificate
+	for block != nil {
+		if block.Type == pemCertificate {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidX5c, err)
+			}
+			certs = append(certs, cert)
+		}
+		block, rest = pem.Decode(rest)
+	}
+	return verifyCertChain(certs, roots)
+}
+
+// compositeKeyProvider looks up signing keys from several providers in
+// order. The key from the first provider that has it is used.
+type compositeKeyProvider []keyProvider
+
+func (p compositeKeyProvider) getSigningKey(kid string) (*jwksSigningKey, error) {
+	err := ErrUnknownSigningKey
+	for _, provider := range p {
+		signingKey, providerErr := provider.getSigningKey(kid)
+		if providerErr == nil {
+			return signingKey, nil
+		}
+
+		// Report errors other than an unknown kid, eg: the JWKS endpoint was
+		// unreachable, if no provider has the key.
+		if !errors.Is(providerErr, ErrUnknownSigningKey) {
+			err = providerErr
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,258 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestRSAKey generates an RSA key used to sign test tokens.
+func newTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+	return key
+}
+
+// newTestRSAJWK returns the JWK of the public key, for use with RS256.
+func newTestRSAJWK(kid string, key *rsa.PrivateKey) *jsonWebKey {
+	return &jsonWebKey{
+		Algorithm: "RS256",
+		ID:        kid,
+		Type:      ktyRSA,
+		Use:       useSignature,
+		Modulus:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		Exponent: base64.RawURLEncoding.EncodeToString(
+			big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// testJWKS returns a JWKS containing the public keys indexed by kid.
+func testJWKS(t *testing.T, keys map[string]*rsa.PrivateKey) []byte {
+	t.Helper()
+	var jwks rawJWKS
+	for kid, key := range keys {
+		jwks.Keys = append(jwks.Keys, newTestRSAJWK(kid, key))
+	}
+
+	jwksBytes, err := json.Marshal(&jwks)
+	if err != nil {
+		t.Fatalf("failed to marshal JWKS: %v", err)
+	}
+	return jwksBytes
+}
+
+// newTestJwksServer starts a JWKS endpoint serving the public keys, and
+// returns the server and a counter of the requests it received.
+func newTestJwksServer(t *testing.T,
+	keys map[string]*rsa.PrivateKey) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	jwksBytes := testJWKS(t, keys)
+	requests := new(atomic.Int32)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.Header().Set(headerContentType, contentTypeJson)
+			_, _ = w.Write(jwksBytes)
+		}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+// testKeyStoreSettings returns JWKS key store settings that allow every
+// unknown kid to trigger a refetch.
+func testKeyStoreSettings() jwksKeyStoreSettings {
+	return jwksKeyStoreSettings{
+		refreshInterval: time.Hour,
+		fetchDeadline:   time.Second * 3,
+	}
+}
+
+// writeTestPemKey writes the public key of the key to a PEM file.
+func writeTestPemKey(t *testing.T, path string, key *rsa.PrivateKey) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: pemPublicKey, Bytes: der})
+	err = os.WriteFile(path, pemBytes, 0600)
+	if err != nil {
+		t.Fatalf("failed to write PEM file: %v", err)
+	}
+}
+
+// assertSigningKey checks that the provider returns the public key of the
+// expected key for the kid.
+func assertSigningKey(t *testing.T, provider keyProvider, kid string,
+	want *rsa.PrivateKey) {
+	t.Helper()
+	signingKey, err := provider.getSigningKey(kid)
+	if err != nil {
+		t.Fatalf("kid %s: failed to get signing key: %v", kid, err)
+	}
+	publicKey, ok := signingKey.publicKey.(*rsa.PublicKey)
+	if !ok || !publicKey.Equal(&want.PublicKey) {
+		t.Errorf("kid %s: unexpected signing key", kid)
+	}
+}
+
+func TestKeyProviderLookupOrder(t *testing.T) {
+	initLogger()
+	fileKey := newTestRSAKey(t)
+	pemKey := newTestRSAKey(t)
+	endpointKey := newTestRSAKey(t)
+
+	// The JWKS file has key1, the PEM directory has key1 and key2, and the
+	// JWKS endpoint has all three keys.
+	dir := t.TempDir()
+	jwksFile := filepath.Join(dir, "jwks.json")
+	err := os.WriteFile(jwksFile,
+		testJWKS(t, map[string]*rsa.PrivateKey{"key1": fileKey}), 0600)
+	if err != nil {
+		t.Fatalf("failed to write JWKS file: %v", err)
+	}
+
+	pemDir := filepath.Join(dir, "pem")
+	err = os.Mkdir(pemDir, 0700)
+	if err != nil {
+		t.Fatalf("failed to create PEM directory: %v", err)
+	}
+	writeTestPemKey(t, filepath.Join(pemDir, "key1.pem"), pemKey)
+	writeTestPemKey(t, filepath.Join(pemDir, "key2.pem"), pemKey)
+
+	server, requests := newTestJwksServer(t, map[string]*rsa.PrivateKey{
+		"key1": endpointKey,
+		"key2": endpointKey,
+		"key3": endpointKey,
+	})
+
+	registry, err := newIssuerRegistry([]issuerConfig{{
+		Issuer:   "test-issuer",
+		JwksUrl:  server.URL,
+		JwksFile: jwksFile,
+		PemDir:   pemDir,
+	}}, testKeyStoreSettings(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create issuer registry: %v", err)
+	}
+	provider := registry.issuers["test-issuer"].keyProvider
+
+	// Keys are looked up from the JWKS file, the PEM directory and the JWKS
+	// endpoint, in that order.
+	assertSigningKey(t, provider, "key1", fileKey)
+	assertSigningKey(t, provider, "key2", pemKey)
+	if requests.Load() != 0 {
+		t.Errorf("JWKS endpoint requested for locally available keys")
+	}
+	assertSigningKey(t, provider, "key3", endpointKey)
+	if requests.Load() != 1 {
+		t.Errorf("expected 1 request to the JWKS endpoint, got %d",
+			requests.Load())
+	}
+
+	_, err = provider.getSigningKey("key4")
+	if !errors.Is(err, ErrUnknownSigningKey) {
+		t.Errorf("expected ErrUnknownSigningKey, got %v", err)
+	}
+}
+
+func TestLocalKeyProviders(t *testing.T) {
+	initLogger()
+	key := newTestRSAKey(t)
+	dir := t.TempDir()
+
+	// Only files with the .pem extension are loaded, named after their kid.
+	writeTestPemKey(t, filepath.Join(dir, "key1.pem"), key)
+	writeTestPemKey(t, filepath.Join(dir, "key2.txt"), key)
+
+	registry, err := newIssuerRegistry([]issuerConfig{{
+		Issuer: "test-issuer",
+		PemDir: dir,
+	}}, testKeyStoreSettings(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create issuer registry: %v", err)
+	}
+	issuer := registry.issuers["test-issuer"]
+	if issuer.keyStore != nil {
+		t.Errorf("JWKS key store configured without a JWKS URL")
+	}
+
+	assertSigningKey(t, issuer.keyProvider, "key1", key)
+	_, err = issuer.keyProvider.getSigningKey("key2")
+	if !errors.Is(err, ErrUnknownSigningKey) {
+		t.Errorf("expected ErrUnknownSigningKey, got %v", err)
+	}
+
+	// A PEM directory without keys is rejected.
+	_, err = newIssuerRegistry([]issuerConfig{{
+		Issuer: "test-issuer",
+		PemDir: t.TempDir(),
+	}}, testKeyStoreSettings(), time.Hour)
+	if !errors.Is(err, ErrInvalidIssuerConfig) {
+		t.Errorf("expected ErrInvalidIssuerConfig, got %v", err)
+	}
+}
+
+// stubKeyProvider is a key provider that returns the specified error for
+// keys it doesn't have.
+type stubKeyProvider struct {
+	keys map[string]*jwksSigningKey
+	err  error
+}
+
+func (p *stubKeyProvider) getSigningKey(kid string) (*jwksSigningKey, error) {
+	if signingKey, ok := p.keys[kid]; ok {
+		return signingKey, nil
+	}
+	return nil, p.err
+}
+
+func TestCompositeKeyProviderErrors(t *testing.T) {
+	errUnavailable := errors.New("JWKS endpoint unavailable")
+	signingKey := &jwksSigningKey{algorithm: "RS256"}
+	provider := compositeKeyProvider{
+		&stubKeyProvider{err: ErrUnknownSigningKey},
+		&stubKeyProvider{
+			keys: map[string]*jwksSigningKey{"key1": signingKey},
+			err:  errUnavailable,
+		},
+	}
+
+	got, err := provider.getSigningKey("key1")
+	if err != nil || got != signingKey {
+		t.Errorf("expected the key of the second provider, got %v, %v", got, err)
+	}
+
+	// Errors other than an unknown kid are reported if no provider has the
+	// key.
+	_, err = provider.getSigningKey("key2")
+	if !errors.Is(err, errUnavailable) {
+		t.Errorf("expected the error of the second provider, got %v", err)
+	}
+
+	_, err = compositeKeyProvider{
+		&stubKeyProvider{err: ErrUnknownSigningKey},
+	}.getSigningKey("key2")
+	if !errors.Is(err, ErrUnknownSigningKey) {
+		t.Errorf("expected ErrUnknownSigningKey, got %v", err)
+	}
+}
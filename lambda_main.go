@@ -7,9 +7,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -24,9 +26,14 @@ const (
 	schedulerAppID      = "bebc5cbf-acc0-431f-8c4e-c582dc2489e2"
 	authorizerUserAgent = "krypton-iot-authorizer"
 
+	// Default deadline for requests made to issuers and list endpoints while
+	// the lambda starts. Lambda initialization is limited to 10 seconds.
+	defaultStartupFetchDeadline = time.Second * 6
+
 	// Request headers
 	headerIotCustomAuthorizer = "x-amz-customauthorizer-name"
 	headerUserAgent           = "User-Agent"
+	headerContentType         = "Content-Type"
 	headerAuthorization       = "Authorization"
 	bearerTokenPrefix         = "Bearer "
 
@@ -42,6 +49,10 @@ const (
 var (
 	// Device STS JWKs endpoint URL.
 	dstsJwksUrl string
+
+	// Audiences expected in access tokens, indexed by token type. Tokens of
+	// a type for which no audiences are configured are rejected.
+	expectedAudiences = map[string][]string{}
 )
 
 type DstsTokenClaims struct {
@@ -60,6 +71,20 @@ type DstsTokenClaims struct {
 
 	// The device management service responsible for managing this device.
 	ManagementService string `json:"ms"`
+
+	// All claims in the token, including custom claims, indexed by name.
+	Raw map[string]interface{} `json:"-"`
+}
+
+// UnmarshalJSON parses the claims in the token, and retains all of them,
+// including custom claims, so that authorization rules can match them.
+func (c *DstsTokenClaims) UnmarshalJSON(data []byte) error {
+	type dstsTokenClaims DstsTokenClaims
+	err := json.Unmarshal(data, (*dstsTokenClaims)(c))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &c.Raw)
 }
 
 func IotDeviceAuthenticationHandler(ctx context.Context,
@@ -160,73 +185,150 @@ func IotDeviceAuthenticationHandler(ctx context.Context,
 		return failedAuthResponse(), ErrUnauthorized
 	}
 
-	switch claims.TokenType {
-	case TokenTypeDeviceAccessToken:
-		if claims.Subject != clientID {
-			iotLogger.Error("Client ID does not match the device ID (sub) of the device access token!")
+	// Verify that devices are still enrolled, and haven't been locked, in the
+	// device registry.
+	err = checkDeviceRegistration(ctx, claims)
+	if err != nil {
+		iotLogger.Error("Device failed the device registry check!",
+			zap.String("Client ID:", clientID),
+			zap.Error(err),
+		)
+		return failedAuthResponse(), ErrUnauthorized
+	}
+
+	// Find the first authorization rule matching the request, which selects
+	// the policy issued to the client. Requests matching no rule are denied.
+	req := &policyRequest{
+		awsRegion:  awsRegion,
+		awsAccount: awsAccount,
+		clientID:   clientID,
+		claims:     claims,
+		protocols:  event.Protocols,
+	}
+	if (event.ProtocolData != nil) && (event.ProtocolData.TLS != nil) {
+		req.serverName = event.ProtocolData.TLS.ServerName
+	}
+
+	rule := findAuthorizationRule(req)
+	if rule == nil {
+		auditDenied(auditReasonNoMatchingRule, claims,
+			zap.String("Client ID:", clientID),
+		)
+		return failedAuthResponse(), ErrUnauthorized
+	}
+	if rule.Effect == ruleEffectDeny {
+		auditDenied(auditReasonDeniedByRule, claims,
+			zap.String("Client ID:", clientID),
+			zap.String("Rule:", rule.Name),
+		)
+		return failedAuthResponse(), ErrUnauthorized
+	}
+
+	err = rule.checkConditions(req)
+	if err != nil {
+		auditDenied(auditReasonConditionNotMet, claims,
+			zap.String("Client ID:", clientID),
+			zap.String("Rule:", rule.Name),
+			zap.Error(err),
+		)
+		return failedAuthResponse(), ErrUnauthorized
+	}
+
+	// Consult the external policy decision point, if one is configured.
+	var decision *pdpDecision
+	if decisionPoint != nil {
+		decision, err = decisionPoint.decide(ctx, req, rule)
+		if err != nil {
+			auditDenied(auditReasonPdpUnavailable, claims,
+				zap.String("Client ID:", clientID),
+				zap.String("Rule:", rule.Name),
+				zap.Error(err),
+			)
 			return failedAuthResponse(), ErrUnauthorized
 		}
-		return successDeviceAuthResponse(awsRegion, awsAccount, claims.Subject), nil
-
-	case TokenTypeAppAccessToken:
-		// Ensure that the token was issued only to the well known scheduler App ID
-		// that is registered with the DSTS.
-		if claims.Subject != schedulerAppID {
-			iotLogger.Error("Only the scheduler app is authorized to connect to the IoT broker!")
+		if !decision.Allow {
+			auditDenied(auditReasonDeniedByPdp, claims,
+				zap.String("Client ID:", clientID),
+				zap.String("Rule:", rule.Name),
+				zap.String("Deny reason:", decision.Reason),
+			)
 			return failedAuthResponse(), ErrUnauthorized
 		}
+	}
+	return successAuthResponse(req, rule, decision)
+}
 
-		// Ensure the client ID requested in the message has the scheduler App ID
-		// as its prefix. The actual client ID may contain a short unique string
-		// so that multiple scheduler pods can connect to the broker with causing
-		// each other to be disconnected due to IoT core's client ID uniqueness
-		// requirements.
-		if !strings.HasPrefix(clientID, claims.Subject) {
-			iotLogger.Error("Client ID does not start with the app ID (sub) of the app access token!")
+// successAuthResponse returns the policy generated for the client by the
+// rule, including any additional topics granted by the policy decision point.
+func successAuthResponse(req *policyRequest, rule *authorizationRule,
+	decision *pdpDecision) (events.IoTCoreCustomAuthorizerResponse, error) {
+	// Devices that have been flagged as compromised are only allowed to
+	// receive remediation tasks.
+	template := rule.PolicyTemplate
+	if req.claims.TokenType == TokenTypeDeviceAccessToken {
+		quarantined, err := isDeviceQuarantined(req.claims.Subject)
+		if err != nil {
+			auditDenied(auditReasonListUnavailable, req.claims,
+				zap.String("Client ID:", req.clientID),
+				zap.String("Rule:", rule.Name),
+				zap.Error(err),
+			)
 			return failedAuthResponse(), ErrUnauthorized
 		}
-		return successAppAuthResponse(awsRegion, awsAccount, clientID), nil
+		if quarantined {
+			iotLogger.Warn("Device is quarantined. Sending quarantine IoT policy document!",
+				zap.String("Device ID:", req.claims.Subject),
+			)
+			template = policyTemplateDeviceQuarantine
+		}
+	}
 
-	default:
-		iotLogger.Error("Invalid token type specified in the access token!",
-			zap.String("Token type:", claims.TokenType),
-		)
-		return failedAuthResponse(), ErrUnauthorized
+	policyDocuments, err := generatePolicy(template, req)
+	if err != nil {
+		return policyErrorResponse(req, rule, template, err)
+	}
+
+	// Topics granted by the policy decision point are not added to the
+	// policy of quarantined devices.
+	if decision != nil && template != policyTemplateDeviceQuarantine {
+		extraPolicyDoc := decision.Topics.policyDocument(req.awsRegion,
+			req.awsAccount)
+		if extraPolicyDoc != nil {
+			policyDocuments = append(policyDocuments, extraPolicyDoc)
+		}
+	}
+
+	principalID, err := rule.principalID(req)
+	if err != nil {
+		return policyErrorResponse(req, rule, template, err)
 	}
-}
 
-func successDeviceAuthResponse(awsRegion string, awsAccount string,
-	deviceID string) events.IoTCoreCustomAuthorizerResponse {
 	// Construct a successful response.
 	response := events.IoTCoreCustomAuthorizerResponse{
-		IsAuthenticated: true,
-		PrincipalID:     strings.Replace(deviceID, "-", "", -1),
-		PolicyDocuments: createIotPolicyDocumentForDevice(awsRegion,
-			awsAccount, deviceID),
-		RefreshAfterInSeconds:    defaultRefreshAfterSeconds,
-		DisconnectAfterInSeconds: defaultDisconnectAfterSeconds,
-	}
-	iotLogger.Debug("Device token validated successfully. Sending IoT policy document!",
+		IsAuthenticated:          true,
+		PrincipalID:              principalID,
+		PolicyDocuments:          policyDocuments,
+		RefreshAfterInSeconds:    rule.RefreshAfterSeconds,
+		DisconnectAfterInSeconds: rule.DisconnectAfterSeconds,
+	}
+	iotLogger.Debug("Access token validated successfully. Sending IoT policy document!",
+		zap.String("Rule:", rule.Name),
 		zap.Any("Policy document:", response),
 	)
-	return response
+	return response, nil
 }
 
-func successAppAuthResponse(awsRegion string, awsAccount string,
-	clientID string) events.IoTCoreCustomAuthorizerResponse {
-	// Construct a successful response.
-	response := events.IoTCoreCustomAuthorizerResponse{
-		IsAuthenticated: true,
-		PrincipalID:     strings.Replace(clientID, "-", "", -1),
-		PolicyDocuments: createIotPolicyDocumentForScheduler(awsRegion,
-			awsAccount, clientID),
-		RefreshAfterInSeconds:    defaultRefreshAfterSeconds,
-		DisconnectAfterInSeconds: defaultDisconnectAfterSeconds,
-	}
-	iotLogger.Debug("App token validated successfully. Sending IoT policy document!",
-		zap.Any("Policy document:", response),
+// policyErrorResponse logs the failure to create the policy for the client
+// and returns a failed response.
+func policyErrorResponse(req *policyRequest, rule *authorizationRule,
+	template string, err error) (events.IoTCoreCustomAuthorizerResponse, error) {
+	iotLogger.Error("Failed to create the IoT policy document for the client!",
+		zap.String("Client ID:", req.clientID),
+		zap.String("Rule:", rule.Name),
+		zap.String("Policy template:", template),
+		zap.Error(err),
 	)
-	return response
+	return failedAuthResponse(), ErrUnauthorized
 }
 
 func failedAuthResponse() events.IoTCoreCustomAuthorizerResponse {
@@ -247,8 +349,20 @@ func failedAuthResponse() events.IoTCoreCustomAuthorizerResponse {
 func validateDstsAccessToken(accessToken string) (*DstsTokenClaims, error) {
 	var claims DstsTokenClaims
 
-	token, err := jwt.ParseWithClaims(accessToken, &claims, getSigningKey)
+	// Restrict the signing algorithms accepted for the token. The algorithm
+	// specified in the token header is checked before any signature
+	// verification is attempted.
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(trustedIssuers.signingAlgorithms))
+	token, err := parser.ParseWithClaims(accessToken, &claims, getSigningKey)
 	if err != nil {
+		if token != nil {
+			alg, _ := token.Header["alg"].(string)
+			if !containsString(trustedIssuers.signingAlgorithms, alg) {
+				return nil, fmt.Errorf("%w: %v", ErrDisallowedSigningAlg,
+					token.Header["alg"])
+			}
+		}
 		return nil, err
 	} else if !token.Valid {
 		return nil, ErrInvalidToken
@@ -258,27 +372,242 @@ func validateDstsAccessToken(accessToken string) (*DstsTokenClaims, error) {
 		return nil, ErrInvalidTokenHeaderSigningAlg
 	}
 
-	if !strings.HasPrefix(claims.Issuer, dstsIssuerName) {
-		return nil, ErrInvalidIssuerClaim
+	issuer, err := trustedIssuers.lookup(claims.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	if !issuer.acceptsTokenType(claims.TokenType) {
+		return nil, fmt.Errorf("%w: %q is not accepted from issuer %q",
+			ErrInvalidTokenType, claims.TokenType, issuer.name)
+	}
+
+	err = verifyAudience(&claims)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkTokenRevocation(&claims)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkTenantSuspension(&claims)
+	if err != nil {
+		return nil, err
 	}
 
 	return &claims, nil
 }
 
+// verifyAudience checks that the audience claim of the token contains one of
+// the audiences expected for tokens of its type.
+func verifyAudience(claims *DstsTokenClaims) error {
+	for _, audience := range expectedAudiences[claims.TokenType] {
+		if claims.VerifyAudience(audience, true) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %v", ErrInvalidAudienceClaim, claims.Audience)
+}
+
 func main() {
 	initLogger()
 	defer shutdownLogger()
 
+	var err error
+	allowedSigningAlgorithms, err = parseSigningAlgorithms(
+		getEnvList(ENV_ALLOWED_SIGNING_ALGORITHMS, defaultSigningAlgorithms))
+	if err != nil {
+		iotLogger.Error("Invalid list of allowed token signing algorithms specified!",
+			zap.Error(err),
+		)
+		return
+	}
+
+	deviceTopicScheme, err = parseTopicScheme(getEnvString(
+		ENV_DEVICE_TOPIC_SCHEME, topicSchemeV1))
+	if err != nil {
+		iotLogger.Error("Invalid device topic scheme specified!",
+			zap.Error(err),
+		)
+		return
+	}
+
+	missingMsClaimBehavior, err = parseMissingMsClaimBehavior(getEnvString(
+		ENV_MISSING_MS_CLAIM_BEHAVIOR, missingMsClaimNoBroadcast))
+	if err != nil {
+		iotLogger.Error("Invalid handling of a missing management service claim specified!",
+			zap.Error(err),
+		)
+		return
+	}
+
+	policyTemplatesFile := os.Getenv(ENV_POLICY_TEMPLATES_FILE)
+	if policyTemplatesFile != "" {
+		err = loadPolicyTemplates(policyTemplatesFile)
+		if err != nil {
+			iotLogger.Error("Failed to load the policy templates!",
+				zap.Error(err),
+			)
+			return
+		}
+	}
+
+	authorizationRulesFile := os.Getenv(ENV_AUTHORIZATION_RULES_FILE)
+	if authorizationRulesFile != "" {
+		err = loadAuthorizationRules(authorizationRulesFile)
+		if err != nil {
+			iotLogger.Error("Failed to load the authorization rules!",
+				zap.Error(err),
+			)
+			return
+		}
+	}
+
+	jwksHttpClient, err = newJwksHttpClient(getHttpClientConfig())
+	if err != nil {
+		iotLogger.Error("Failed to configure the HTTP client for the DSTS!",
+			zap.Error(err),
+		)
+		return
+	}
+	fetchMaxAttempts = getEnvInt(ENV_JWKS_FETCH_MAX_ATTEMPTS,
+		defaultFetchMaxAttempts)
+
+	issuersConfig := os.Getenv(ENV_DSTS_TRUSTED_ISSUERS)
+	issuersConfigFile := os.Getenv(ENV_DSTS_TRUSTED_ISSUERS_FILE)
+	dstsIssuerUrl := os.Getenv(ENV_DSTS_ISSUER_URL)
 	dstsJwksUrl = os.Getenv(ENV_DSTS_JWKS_URL)
-	if dstsJwksUrl == "" {
+	if dstsJwksUrl == "" && dstsIssuerUrl == "" &&
+		issuersConfig == "" && issuersConfigFile == "" {
 		iotLogger.Panic("Required DSTS JWKS URL environment variable is not specified!")
 		return
 	}
 
-	// Get the token signing key from the DSTS.
-	err := getJWKSSigningKey(dstsJwksUrl)
+	issuerConfigs, err := loadIssuerConfig(issuersConfig, issuersConfigFile,
+		dstsJwksUrl, dstsIssuerUrl)
+	if err == nil {
+		var settings jwksKeyStoreSettings
+		settings, err = getJwksKeyStoreSettings()
+		if err == nil {
+			trustedIssuers, err = newIssuerRegistry(issuerConfigs, settings,
+				getEnvDuration(ENV_OIDC_DISCOVERY_INTERVAL,
+					defaultOidcDiscoveryInterval))
+		}
+	}
+	if err != nil {
+		iotLogger.Error("Failed to configure the trusted token issuers!",
+			zap.Error(err),
+		)
+		return
+	}
+
+	expectedAudiences[TokenTypeDeviceAccessToken] = getEnvList(
+		ENV_DEVICE_TOKEN_AUDIENCES, nil)
+	expectedAudiences[TokenTypeAppAccessToken] = getEnvList(
+		ENV_APP_TOKEN_AUDIENCES, nil)
+	for tokenType, audiences := range expectedAudiences {
+		if len(audiences) == 0 {
+			iotLogger.Error("Required expected audiences are not configured for the token type!",
+				zap.String("Token type:", tokenType),
+			)
+			return
+		}
+	}
+
+	// Bound the time spent on requests to issuers and list endpoints while
+	// the lambda starts, so that unreachable endpoints don't cause the lambda
+	// to exceed its initialization time limit. Signing keys and lists that
+	// could not be retrieved are retried in the background.
+	startupCtx, cancel := context.WithTimeout(context.Background(),
+		getEnvDuration(ENV_STARTUP_FETCH_DEADLINE, defaultStartupFetchDeadline))
+	defer cancel()
+
+	// Get the token signing keys from the trusted issuers. If an issuer is
+	// unreachable, fall back to the last known good signing keys so that
+	// devices can continue to connect until the issuer recovers.
+	jwksSnapshots.maxStaleness = getEnvDuration(ENV_JWKS_SNAPSHOT_MAX_STALENESS,
+		defaultJwksSnapshotMaxStaleness)
+	jwksSnapshots.file = os.Getenv(ENV_JWKS_SNAPSHOT_FILE)
+	for _, issuer := range trustedIssuers.issuers {
+		if issuer.keyStore == nil {
+			continue
+		}
+
+		err = issuer.keyStore.refresh(startupCtx)
+		if err == nil {
+			continue
+		}
+		iotLogger.Error("Failed to get the JWKS signing key! Falling back to snapshot.",
+			zap.String("Issuer:", issuer.name),
+			zap.Error(err),
+		)
+
+		err = issuer.keyStore.loadSnapshot()
+		if err != nil {
+			iotLogger.Error("No JWKS snapshot available. Tokens from the issuer will be rejected until its signing keys are retrieved!",
+				zap.String("Issuer:", issuer.name),
+				zap.Error(err),
+			)
+		}
+	}
+
+	listFailureMode := getEnvString(ENV_LIST_FAILURE_MODE, listFailOpen)
+	revokedTokens, err = newRefreshableList(startupCtx, "revoked tokens",
+		os.Getenv(ENV_REVOCATION_LIST_FILE), os.Getenv(ENV_REVOCATION_LIST_URL),
+		getEnvDuration(ENV_REVOCATION_LIST_REFRESH_INTERVAL,
+			defaultListRefreshInterval), listFailureMode)
+	if err != nil {
+		iotLogger.Error("Failed to configure the token revocation list!",
+			zap.Error(err),
+		)
+		return
+	}
+
+	quarantinedDevices, err = newRefreshableList(startupCtx, "quarantined devices",
+		os.Getenv(ENV_QUARANTINE_LIST_FILE), os.Getenv(ENV_QUARANTINE_LIST_URL),
+		getEnvDuration(ENV_QUARANTINE_LIST_REFRESH_INTERVAL,
+			defaultListRefreshInterval), listFailureMode)
+	if err != nil {
+		iotLogger.Error("Failed to configure the device quarantine list!",
+			zap.Error(err),
+		)
+		return
+	}
+
+	suspendedTenants, err = newRefreshableList(startupCtx, "suspended tenants",
+		os.Getenv(ENV_SUSPENDED_TENANTS_FILE), os.Getenv(ENV_SUSPENDED_TENANTS_URL),
+		getEnvDuration(ENV_SUSPENDED_TENANTS_REFRESH_INTERVAL,
+			defaultListRefreshInterval), listFailureMode)
+	if err != nil {
+		iotLogger.Error("Failed to configure the suspended tenant list!",
+			zap.Error(err),
+		)
+		return
+	}
+
+	pdpUrl := os.Getenv(ENV_PDP_URL)
+	if pdpUrl != "" {
+		decisionPoint, err = newPolicyDecisionPoint(pdpUrl,
+			getEnvDuration(ENV_PDP_TIMEOUT, defaultPdpTimeout),
+			getEnvString(ENV_PDP_FAILURE_MODE, pdpFailClosed),
+			getEnvDuration(ENV_PDP_CACHE_TTL, defaultPdpCacheTTL))
+		if err != nil {
+			iotLogger.Error("Failed to configure the policy decision point!",
+				zap.Error(err),
+			)
+			return
+		}
+	}
+
+	deviceRegistry, err = newDeviceRegistry(os.Getenv(ENV_DEVICE_REGISTRY_FILE),
+		os.Getenv(ENV_DEVICE_REGISTRY_URL),
+		getEnvDuration(ENV_DEVICE_REGISTRY_TIMEOUT, defaultDeviceRegistryTimeout),
+		getEnvInt(ENV_DEVICE_REGISTRY_CACHE_SIZE, defaultDeviceRegistryCacheSize),
+		getEnvDuration(ENV_DEVICE_REGISTRY_CACHE_TTL, defaultDeviceRegistryCacheTTL))
 	if err != nil {
-		iotLogger.Error("Failed to get the JWKS signing key!",
+		iotLogger.Error("Failed to configure the device registry!",
 			zap.Error(err),
 		)
 		return
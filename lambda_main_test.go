@@ -0,0 +1,172 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// setExpectedAudiences sets the expected audiences for the duration of the
+// test.
+func setExpectedAudiences(t *testing.T, audiences map[string][]string) {
+	oldAudiences := expectedAudiences
+	expectedAudiences = audiences
+	t.Cleanup(func() {
+		expectedAudiences = oldAudiences
+	})
+}
+
+func TestVerifyAudience(t *testing.T) {
+	setExpectedAudiences(t, map[string][]string{
+		TokenTypeDeviceAccessToken: {"iot", "iot-staging"},
+		TokenTypeAppAccessToken:    {"iot-scheduler"},
+	})
+
+	tests := []struct {
+		name      string
+		tokenType string
+		audience  jwt.ClaimStrings
+		wantErr   error
+	}{
+		{"matching", TokenTypeDeviceAccessToken, jwt.ClaimStrings{"iot-staging"}, nil},
+		{"one of several", TokenTypeDeviceAccessToken,
+			jwt.ClaimStrings{"fleet", "iot"}, nil},
+		{"mismatched", TokenTypeDeviceAccessToken, jwt.ClaimStrings{"fleet"},
+			ErrInvalidAudienceClaim},
+		{"audience of other token type", TokenTypeAppAccessToken,
+			jwt.ClaimStrings{"iot"}, ErrInvalidAudienceClaim},
+		{"missing", TokenTypeDeviceAccessToken, nil, ErrInvalidAudienceClaim},
+		{"no audiences configured", "other", jwt.ClaimStrings{"iot"},
+			ErrInvalidAudienceClaim},
+	}
+	for _, tt := range tests {
+		claims := &DstsTokenClaims{TokenType: tt.tokenType}
+		claims.Audience = tt.audience
+		err := verifyAudience(claims)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
+
+// setTestIssuers configures the trusted issuers for the duration of the test.
+// Both issuers use the key as key1, which the JWKS specifies for use with
+// RS256. Tokens from test-issuer may be signed using RS256 or RS384, and
+// tokens from other-issuer using PS256.
+func setTestIssuers(t *testing.T, key *rsa.PrivateKey) {
+	t.Helper()
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	err := os.WriteFile(jwksFile,
+		testJWKS(t, map[string]*rsa.PrivateKey{"key1": key}), 0600)
+	if err != nil {
+		t.Fatalf("failed to write JWKS file: %v", err)
+	}
+
+	setTrustedIssuers(t,
+		issuerConfig{
+			Issuer:            "test-issuer",
+			JwksFile:          jwksFile,
+			SigningAlgorithms: []string{"RS256", "RS384"},
+		},
+		issuerConfig{
+			Issuer:            "other-issuer",
+			JwksFile:          jwksFile,
+			SigningAlgorithms: []string{"PS256"},
+		})
+}
+
+// setTrustedIssuers configures the trusted issuers, and the audience expected
+// in device access tokens, for the duration of the test.
+func setTrustedIssuers(t *testing.T, configs ...issuerConfig) {
+	t.Helper()
+	registry, err := newIssuerRegistry(configs, testKeyStoreSettings(),
+		time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create issuer registry: %v", err)
+	}
+
+	oldIssuers := trustedIssuers
+	trustedIssuers = registry
+	t.Cleanup(func() {
+		trustedIssuers = oldIssuers
+	})
+	setExpectedAudiences(t, map[string][]string{
+		TokenTypeDeviceAccessToken: {"iot"},
+	})
+}
+
+// newTestToken returns the claims of a device access token from test-issuer.
+func newTestToken() *DstsTokenClaims {
+	claims := &DstsTokenClaims{TokenType: TokenTypeDeviceAccessToken}
+	claims.Issuer = "test-issuer"
+	claims.Subject = "dev-1"
+	claims.Audience = jwt.ClaimStrings{"iot"}
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Hour))
+	return claims
+}
+
+// signTestToken signs the token using the method and key, with the kid key1.
+func signTestToken(t *testing.T, method jwt.SigningMethod,
+	claims *DstsTokenClaims, key interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = "key1"
+	signedToken, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signedToken
+}
+
+func TestSigningAlgorithmRestrictions(t *testing.T) {
+	initLogger()
+	key := newTestRSAKey(t)
+	setTestIssuers(t, key)
+
+	// The PEM encoding of the public key, as it would be used by an attacker
+	// who signs a token using HMAC and the public key as the secret.
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	publicKeyPem := pem.EncodeToMemory(&pem.Block{Type: pemPublicKey, Bytes: der})
+
+	otherIssuerToken := newTestToken()
+	otherIssuerToken.Issuer = "other-issuer"
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"allowed", signTestToken(t, jwt.SigningMethodRS256, newTestToken(), key),
+			nil},
+		{"none", signTestToken(t, jwt.SigningMethodNone, newTestToken(),
+			jwt.UnsafeAllowNoneSignatureType), ErrDisallowedSigningAlg},
+		{"HS256 with public key", signTestToken(t, jwt.SigningMethodHS256,
+			newTestToken(), publicKeyPem), ErrDisallowedSigningAlg},
+		{"not allowed for issuer", signTestToken(t, jwt.SigningMethodPS256,
+			newTestToken(), key), ErrDisallowedSigningAlg},
+		{"allowed for other issuer", signTestToken(t, jwt.SigningMethodPS256,
+			otherIssuerToken, key), ErrSigningKeyAlgMismatch},
+		{"not the alg of the key", signTestToken(t, jwt.SigningMethodRS384,
+			newTestToken(), key), ErrSigningKeyAlgMismatch},
+	}
+	for _, tt := range tests {
+		_, err := validateDstsAccessToken(tt.token)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
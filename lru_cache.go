@@ -0,0 +1,88 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCache is a cache of values that expire, indexed by key. The least
+// recently used entry is evicted when the cache is full. It is safe for
+// concurrent use.
+type lruCache struct {
+	// Maximum number of cached entries.
+	size int
+
+	// Protects the fields below.
+	lock sync.Mutex
+
+	// Cached entries ordered from most to least recently used, and indexed
+	// by key.
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// lruCacheEntry is a value cached by the lruCache.
+type lruCacheEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time
+}
+
+func newLruCache(size int) *lruCache {
+	return &lruCache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached value for the key, and whether it was cached.
+// Expired entries are removed.
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*lruCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return entry.value, true
+}
+
+// add caches the value for the key until the specified time, evicting the
+// least recently used entry if the cache is full.
+func (c *lruCache) add(key string, value interface{}, expiresAt time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry := &lruCacheEntry{
+		key:       key,
+		value:     value,
+		expiresAt: expiresAt,
+	}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruCacheEntry).key)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+}
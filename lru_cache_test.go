@@ -0,0 +1,36 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLruCache(t *testing.T) {
+	cache := newLruCache(2)
+	expiresAt := time.Now().Add(time.Minute)
+	cache.add("a", 1, expiresAt)
+	cache.add("b", 2, expiresAt)
+
+	// Using 'a' makes 'b' the least recently used entry, which is evicted
+	// when 'c' is added.
+	if value, ok := cache.get("a"); !ok || value != 1 {
+		t.Fatalf("expected a=1, got %v, %v", value, ok)
+	}
+	cache.add("c", 3, expiresAt)
+	if _, ok := cache.get("b"); ok {
+		t.Errorf("expected b to be evicted")
+	}
+	if value, ok := cache.get("c"); !ok || value != 3 {
+		t.Errorf("expected c=3, got %v, %v", value, ok)
+	}
+
+	// Expired entries are not returned.
+	cache.add("a", 4, time.Now().Add(-time.Second))
+	if _, ok := cache.get("a"); ok {
+		t.Errorf("expected a to be expired")
+	}
+}
@@ -0,0 +1,287 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"go.uber.org/zap"
+)
+
+const (
+	// Default timeout for requests to the policy decision point. Requests
+	// are not retried, to keep the latency of connection requests low.
+	defaultPdpTimeout = time.Millisecond * 500
+
+	// Default duration for which decisions are cached.
+	defaultPdpCacheTTL = time.Minute * 5
+
+	// Maximum number of decisions cached.
+	maxPdpCacheSize = 10000
+
+	// Handling of requests when the policy decision point is unavailable.
+	pdpFailClosed = "fail_closed"
+	pdpFailOpen   = "fail_open"
+
+	contentTypeJson = "application/json"
+)
+
+// policyDecisionPoint is an external HTTP service consulted after the
+// access token is validated, to decide whether the connection request is
+// allowed, eg: based on the enrollment state of the device or the license of
+// its tenant.
+type policyDecisionPoint struct {
+	// URL to which decision requests are posted.
+	url string
+
+	// HTTP client used for decision requests, with a strict timeout.
+	client *http.Client
+
+	// Whether requests are allowed when the policy decision point is
+	// unavailable.
+	failOpen bool
+
+	// Duration for which decisions are cached.
+	cacheTTL time.Duration
+
+	// Cached decisions indexed by token ID, client ID and rule.
+	cache *lruCache
+}
+
+// pdpRequest is posted to the policy decision point.
+type pdpRequest struct {
+	// All claims in the validated access token.
+	Claims map[string]interface{} `json:"claims"`
+
+	// Attributes of the connection request.
+	Request pdpRequestAttributes `json:"request"`
+
+	// Name of the authorization rule that matched the request.
+	Rule string `json:"rule"`
+}
+
+// pdpRequestAttributes are the attributes of the connection request sent to
+// the policy decision point.
+type pdpRequestAttributes struct {
+	ClientID   string   `json:"clientId"`
+	Protocols  []string `json:"protocols"`
+	ServerName string   `json:"serverName"`
+	Region     string   `json:"region"`
+	Account    string   `json:"account"`
+}
+
+// pdpDecision is returned by the policy decision point.
+type pdpDecision struct {
+	// Whether the connection request is allowed.
+	Allow bool `json:"allow"`
+
+	// Reason for denying the request, recorded in the audit log entry.
+	Reason string `json:"reason"`
+
+	// Topics the client is allowed to access in addition to those in its
+	// policy.
+	Topics pdpTopics `json:"topics"`
+}
+
+// pdpTopics are the topics, and topic filters, that a client is allowed to
+// access in addition to those in its policy.
+type pdpTopics struct {
+	Subscribe []string `json:"subscribe"`
+	Receive   []string `json:"receive"`
+	Publish   []string `json:"publish"`
+}
+
+// decisionPoint is the external policy decision point. It is nil if no
+// policy decision point is configured.
+var decisionPoint *policyDecisionPoint
+
+// newPolicyDecisionPoint configures the policy decision point at the
+// specified URL.
+func newPolicyDecisionPoint(pdpUrl string, timeout time.Duration,
+	failureMode string, cacheTTL time.Duration) (*policyDecisionPoint, error) {
+	parsedUrl, err := url.Parse(pdpUrl)
+	if err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") ||
+		parsedUrl.Host == "" {
+		return nil, fmt.Errorf("%w: invalid URL: %s", ErrInvalidPdpConfig, pdpUrl)
+	}
+	if failureMode != pdpFailClosed && failureMode != pdpFailOpen {
+		return nil, fmt.Errorf("%w: invalid failure mode: %s",
+			ErrInvalidPdpConfig, failureMode)
+	}
+
+	return &policyDecisionPoint{
+		url:      pdpUrl,
+		client:   newServiceHttpClient(timeout),
+		failOpen: failureMode == pdpFailOpen,
+		cacheTTL: cacheTTL,
+		cache:    newLruCache(maxPdpCacheSize),
+	}, nil
+}
+
+// decide returns the decision of the policy decision point for the request.
+// Decisions are cached by token ID, client ID and rule, until the token
+// expires or the cache TTL elapses. If the policy decision point is
+// unavailable, the request is allowed without additional topics if configured
+// to fail open, and an error is returned otherwise.
+func (p *policyDecisionPoint) decide(ctx context.Context, req *policyRequest,
+	rule *authorizationRule) (*pdpDecision, error) {
+	cacheKey := pdpCacheKey(req, rule)
+	if decision := p.getCachedDecision(cacheKey); decision != nil {
+		return decision, nil
+	}
+
+	decision, err := p.query(ctx, req, rule)
+	if err != nil {
+		if p.failOpen {
+			iotLogger.Warn("Policy decision point is unavailable. Allowing the request!",
+				zap.String("URL:", p.url),
+				zap.Error(err),
+			)
+			return &pdpDecision{Allow: true}, nil
+		}
+		return nil, fmt.Errorf("%w: %v", ErrPdpUnavailable, err)
+	}
+
+	p.cacheDecision(cacheKey, decision, req.claims)
+	return decision, nil
+}
+
+// query posts the request to the policy decision point.
+func (p *policyDecisionPoint) query(ctx context.Context, req *policyRequest,
+	rule *authorizationRule) (*pdpDecision, error) {
+	protocols := req.protocols
+	if protocols == nil {
+		protocols = []string{}
+	}
+
+	requestBody, err := json.Marshal(&pdpRequest{
+		Claims: req.claims.Raw,
+		Request: pdpRequestAttributes{
+			ClientID:   req.clientID,
+			Protocols:  protocols,
+			ServerName: req.serverName,
+			Region:     req.awsRegion,
+			Account:    req.awsAccount,
+		},
+		Rule: rule.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url,
+		bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set(headerContentType, contentTypeJson)
+	httpReq.Header.Set(headerUserAgent, authorizerUserAgent)
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{
+			URL:        p.url,
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	responseBody, err := readLimitedBody(resp, p.url)
+	if err != nil {
+		return nil, err
+	}
+
+	var decision pdpDecision
+	err = json.Unmarshal(responseBody, &decision)
+	if err != nil {
+		return nil, err
+	}
+	return &decision, nil
+}
+
+// pdpCacheKey returns the key of the cached decision for the request. The
+// decision depends on the claims in the token, the client ID and the rule,
+// so the same token used with another client ID, or matching another rule,
+// is decided again. Decisions for tokens without an ID are not cached.
+func pdpCacheKey(req *policyRequest, rule *authorizationRule) string {
+	if req.claims.ID == "" {
+		return ""
+	}
+	return req.claims.ID + "\x00" + req.clientID + "\x00" + rule.Name
+}
+
+// getCachedDecision returns the cached decision, or nil if no decision is
+// cached.
+func (p *policyDecisionPoint) getCachedDecision(cacheKey string) *pdpDecision {
+	if cacheKey == "" {
+		return nil
+	}
+
+	decision, ok := p.cache.get(cacheKey)
+	if !ok {
+		return nil
+	}
+	return decision.(*pdpDecision)
+}
+
+// cacheDecision caches the decision until the token expires or the cache
+// TTL elapses, evicting the least recently used decision if the cache is
+// full.
+func (p *policyDecisionPoint) cacheDecision(cacheKey string,
+	decision *pdpDecision, claims *DstsTokenClaims) {
+	if cacheKey == "" {
+		return
+	}
+
+	expiresAt := time.Now().Add(p.cacheTTL)
+	if claims.ExpiresAt != nil && claims.ExpiresAt.Before(expiresAt) {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	p.cache.add(cacheKey, decision, expiresAt)
+}
+
+// policyDocument returns a policy document granting access to the additional
+// topics, or nil if there are none.
+func (t *pdpTopics) policyDocument(awsRegion string,
+	awsAccount string) *events.IAMPolicyDocument {
+	policyDoc := events.IAMPolicyDocument{Version: policyVersion}
+	addStatement := func(action []string, resourceType string,
+		topics []string) {
+		if len(topics) == 0 {
+			return
+		}
+
+		resources := make([]string, 0, len(topics))
+		for _, topic := range topics {
+			resources = append(resources, fmt.Sprintf("arn:aws:iot:%s:%s:%s/%s",
+				awsRegion, awsAccount, resourceType, topic))
+		}
+		policyDoc.Statement = append(policyDoc.Statement,
+			events.IAMPolicyStatement{
+				Action:   action,
+				Effect:   policyEffectAllow,
+				Resource: resources,
+			})
+	}
+
+	addStatement(subscribeAction, "topicfilter", t.Subscribe)
+	addStatement(receiveAction, "topic", t.Receive)
+	addStatement(publishAction, "topic", t.Publish)
+	if len(policyDoc.Statement) == 0 {
+		return nil
+	}
+	return &policyDoc
+}
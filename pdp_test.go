@@ -0,0 +1,263 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// testPdpServer is a stub policy decision point, which returns the same
+// response to every request and records the requests it received.
+type testPdpServer struct {
+	*httptest.Server
+
+	// Status code and decision returned for requests.
+	statusCode int
+	decision   pdpDecision
+
+	// Protects the requests received.
+	lock     sync.Mutex
+	requests []pdpRequest
+}
+
+func newTestPdpServer(t *testing.T, statusCode int,
+	decision pdpDecision) *testPdpServer {
+	t.Helper()
+	server := &testPdpServer{statusCode: statusCode, decision: decision}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serve))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *testPdpServer) serve(w http.ResponseWriter, r *http.Request) {
+	var req pdpRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || r.Method != http.MethodPost ||
+		r.Header.Get(headerContentType) != contentTypeJson {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	s.requests = append(s.requests, req)
+	s.lock.Unlock()
+
+	w.Header().Set(headerContentType, contentTypeJson)
+	w.WriteHeader(s.statusCode)
+	_ = json.NewEncoder(w).Encode(&s.decision)
+}
+
+// requestCount returns the number of requests received.
+func (s *testPdpServer) requestCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.requests)
+}
+
+// newTestDecisionPoint configures a policy decision point at the URL of the
+// stub server.
+func newTestDecisionPoint(t *testing.T, server *testPdpServer,
+	failureMode string) *policyDecisionPoint {
+	t.Helper()
+	decisionPoint, err := newPolicyDecisionPoint(server.URL, time.Second,
+		failureMode, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to configure the policy decision point: %v", err)
+	}
+	return decisionPoint
+}
+
+// newTestPdpRequest returns a request for a device access token with the
+// specified token ID.
+func newTestPdpRequest(tokenID string, clientID string) *policyRequest {
+	req := newTestPolicyRequest(TokenTypeDeviceAccessToken, "dev-1", clientID,
+		"hpcem", "t1")
+	req.claims.ID = tokenID
+	req.claims.Raw["jti"] = tokenID
+	req.protocols = []string{"tls", "mqtt"}
+	return req
+}
+
+func TestPdpAllow(t *testing.T) {
+	initLogger()
+	server := newTestPdpServer(t, http.StatusOK, pdpDecision{
+		Allow: true,
+		Topics: pdpTopics{
+			Subscribe: []string{"v1/dev-1/extra"},
+			Receive:   []string{"v1/dev-1/extra"},
+		},
+	})
+	decisionPoint := newTestDecisionPoint(t, server, pdpFailClosed)
+
+	req := newTestPdpRequest("token-1", "dev-1")
+	decision, err := decisionPoint.decide(context.Background(), req,
+		&authorizationRule{Name: "device"})
+	if err != nil {
+		t.Fatalf("failed to get a decision: %v", err)
+	}
+	if !decision.Allow {
+		t.Errorf("expected the request to be allowed")
+	}
+
+	// The claims, request attributes and rule are posted to the policy
+	// decision point.
+	server.lock.Lock()
+	posted := server.requests[0]
+	server.lock.Unlock()
+	if posted.Rule != "device" || posted.Claims["sub"] != "dev-1" ||
+		posted.Request.ClientID != "dev-1" ||
+		!reflect.DeepEqual(posted.Request.Protocols, req.protocols) ||
+		posted.Request.Region != testRegion {
+		t.Errorf("unexpected request posted: %+v", posted)
+	}
+
+	want := []events.IAMPolicyStatement{
+		testStatement("iot:Subscribe", "topicfilter/v1/dev-1/extra"),
+		testStatement("iot:Receive", "topic/v1/dev-1/extra"),
+	}
+	policyDoc := decision.Topics.policyDocument(testRegion, testAccount)
+	if policyDoc == nil || !reflect.DeepEqual(policyDoc.Statement, want) {
+		t.Errorf("unexpected policy for additional topics: %+v", policyDoc)
+	}
+}
+
+func TestPdpDeny(t *testing.T) {
+	initLogger()
+	server := newTestPdpServer(t, http.StatusOK, pdpDecision{
+		Allow:  false,
+		Reason: "license expired",
+	})
+	decisionPoint := newTestDecisionPoint(t, server, pdpFailClosed)
+
+	decision, err := decisionPoint.decide(context.Background(),
+		newTestPdpRequest("token-1", "dev-1"), &authorizationRule{Name: "device"})
+	if err != nil {
+		t.Fatalf("failed to get a decision: %v", err)
+	}
+	if decision.Allow || decision.Reason != "license expired" {
+		t.Errorf("unexpected decision: %+v", decision)
+	}
+	if decision.Topics.policyDocument(testRegion, testAccount) != nil {
+		t.Errorf("expected no policy for additional topics")
+	}
+}
+
+func TestPdpUnavailable(t *testing.T) {
+	initLogger()
+	server := newTestPdpServer(t, http.StatusServiceUnavailable,
+		pdpDecision{Allow: true})
+	rule := &authorizationRule{Name: "device"}
+
+	// Requests are denied if the policy decision point fails closed.
+	decisionPoint := newTestDecisionPoint(t, server, pdpFailClosed)
+	_, err := decisionPoint.decide(context.Background(),
+		newTestPdpRequest("token-1", "dev-1"), rule)
+	if !errors.Is(err, ErrPdpUnavailable) {
+		t.Errorf("expected ErrPdpUnavailable, got %v", err)
+	}
+
+	// Requests are allowed without additional topics if the policy decision
+	// point fails open.
+	decisionPoint = newTestDecisionPoint(t, server, pdpFailOpen)
+	decision, err := decisionPoint.decide(context.Background(),
+		newTestPdpRequest("token-1", "dev-1"), rule)
+	if err != nil {
+		t.Fatalf("failed to get a decision: %v", err)
+	}
+	if !decision.Allow ||
+		decision.Topics.policyDocument(testRegion, testAccount) != nil {
+		t.Errorf("unexpected decision: %+v", decision)
+	}
+
+	// Failures are not cached.
+	_, _ = decisionPoint.decide(context.Background(),
+		newTestPdpRequest("token-1", "dev-1"), rule)
+	if server.requestCount() != 3 {
+		t.Errorf("expected 3 requests, got %d", server.requestCount())
+	}
+}
+
+func TestPdpCaching(t *testing.T) {
+	initLogger()
+	server := newTestPdpServer(t, http.StatusOK, pdpDecision{Allow: true})
+	decisionPoint := newTestDecisionPoint(t, server, pdpFailClosed)
+	deviceRule := &authorizationRule{Name: "device"}
+	otherRule := &authorizationRule{Name: "other"}
+
+	tests := []struct {
+		name      string
+		req       *policyRequest
+		rule      *authorizationRule
+		wantCount int
+	}{
+		{"first request", newTestPdpRequest("token-1", "dev-1"), deviceRule, 1},
+		{"same token", newTestPdpRequest("token-1", "dev-1"), deviceRule, 1},
+		{"other client ID", newTestPdpRequest("token-1", "dev-2"), deviceRule, 2},
+		{"other rule", newTestPdpRequest("token-1", "dev-1"), otherRule, 3},
+		{"other token", newTestPdpRequest("token-2", "dev-1"), deviceRule, 4},
+		{"no token ID", newTestPdpRequest("", "dev-1"), deviceRule, 5},
+		{"no token ID again", newTestPdpRequest("", "dev-1"), deviceRule, 6},
+	}
+	for _, tt := range tests {
+		_, err := decisionPoint.decide(context.Background(), tt.req, tt.rule)
+		if err != nil {
+			t.Fatalf("%s: failed to get a decision: %v", tt.name, err)
+		}
+		if server.requestCount() != tt.wantCount {
+			t.Errorf("%s: expected %d requests, got %d", tt.name, tt.wantCount,
+				server.requestCount())
+		}
+	}
+}
+
+func TestPdpCacheExpiresWithToken(t *testing.T) {
+	initLogger()
+	server := newTestPdpServer(t, http.StatusOK, pdpDecision{Allow: true})
+	decisionPoint := newTestDecisionPoint(t, server, pdpFailClosed)
+	rule := &authorizationRule{Name: "device"}
+
+	// Decisions are not cached beyond the expiry of the token.
+	for i := 0; i < 2; i++ {
+		req := newTestPdpRequest("token-1", "dev-1")
+		req.claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Second))
+		_, err := decisionPoint.decide(context.Background(), req, rule)
+		if err != nil {
+			t.Fatalf("failed to get a decision: %v", err)
+		}
+	}
+	if server.requestCount() != 2 {
+		t.Errorf("expected 2 requests, got %d", server.requestCount())
+	}
+}
+
+func TestNewPolicyDecisionPointConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		failureMode string
+	}{
+		{"no scheme", "pdp.example.com/decide", pdpFailClosed},
+		{"unsupported scheme", "ftp://pdp.example.com", pdpFailClosed},
+		{"invalid failure mode", "https://pdp.example.com", "fail_sometimes"},
+	}
+	for _, tt := range tests {
+		_, err := newPolicyDecisionPoint(tt.url, time.Second, tt.failureMode,
+			time.Minute)
+		if !errors.Is(err, ErrInvalidPdpConfig) {
+			t.Errorf("%s: expected ErrInvalidPdpConfig, got %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"go.uber.org/zap"
+)
+
+// Names of the built-in policy templates.
+const (
+	policyTemplateDevice           = "device"
+	policyTemplateDeviceQuarantine = "device_quarantine"
+	policyTemplateScheduler        = "scheduler"
+)
+
+const (
+	policyVersion        = "2012-10-17"
+	policyEffectAllow    = "Allow"
+	policyEffectDeny     = "Deny"
+	policyActionPrefix   = "iot:"
+	policyResourcePrefix = "arn:aws:iot:"
+)
+
+var (
+	// AWS IoT Core policy actions.
+	publishAction   = []string{"iot:Publish"}
+	receiveAction   = []string{"iot:Receive"}
+	subscribeAction = []string{"iot:Subscribe"}
+)
+
+// Variables that may be used in the resources of policy templates.
+const (
+	policyVarSubject  = "sub"
+	policyVarRegion   = "region"
+	policyVarAccount  = "account"
+	policyVarDeviceID = "deviceId"
+	policyVarClientID = "clientId"
+	policyVarTenantID = "tenantId"
+	policyVarMs       = "ms"
+)
+
+// Matches variables, eg: ${deviceId}, in the resources of policy templates.
+// AWS IoT policy variables, eg: ${iot:ClientId}, are passed through as-is.
+var policyVariableRegex = regexp.MustCompile(`\$\{([^}:]*)\}`)
+
+// policyRequest describes the authenticated client for which a policy is
+// generated.
+type policyRequest struct {
+	awsRegion  string
+	awsAccount string
+	clientID   string
+	claims     *DstsTokenClaims
+
+	// Protocols used by the client and the server name (SNI) specified by
+	// the client in the TLS handshake.
+	protocols  []string
+	serverName string
+}
+
+// Built-in policy templates, in the format of the policy templates file.
+//
+//go:embed default_policy_templates.yaml
+var defaultPolicyTemplatesYaml []byte
+
+// policyTemplates contains the policy templates indexed by name. It is
+// initialized with the built-in templates, which may be overridden by
+// templates loaded from the policy templates file.
+var policyTemplates = mustParseDefaultPolicyTemplates()
+
+// policyTemplateSelectors contains the built-in policies that select the
+// template issued to the client using the configured topic scheme and the
+// claims of the access token, indexed by name.
+var policyTemplateSelectors = map[string]func(
+	req *policyRequest) (string, error){
+	policyTemplateDevice:           selectDeviceTemplate,
+	policyTemplateDeviceQuarantine: selectQuarantineTemplate,
+	policyTemplateScheduler:        selectSchedulerTemplate,
+}
+
+// mustParseDefaultPolicyTemplates parses the built-in policy templates. The
+// templates are embedded in the lambda, so an invalid template is a bug.
+func mustParseDefaultPolicyTemplates() map[string]*policyTemplate {
+	var templatesFile policyTemplatesFile
+	err := decodeYamlConfig(defaultPolicyTemplatesYaml, &templatesFile)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse the built-in policy templates: %v",
+			err))
+	}
+
+	err = templatesFile.validate()
+	if err != nil {
+		panic(fmt.Sprintf("invalid built-in policy template: %v", err))
+	}
+	return templatesFile.Templates
+}
+
+// isPolicyTemplate checks whether a policy template or a built-in policy with
+// the specified name exists.
+func isPolicyTemplate(name string) bool {
+	if _, ok := policyTemplateSelectors[name]; ok {
+		return true
+	}
+	_, ok := policyTemplates[name]
+	return ok
+}
+
+// generatePolicy generates the policy documents for the client using the
+// policy template with the specified name.
+func generatePolicy(name string,
+	req *policyRequest) ([]*events.IAMPolicyDocument, error) {
+	if selectTemplate, ok := policyTemplateSelectors[name]; ok {
+		var err error
+		name, err = selectTemplate(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	template, ok := policyTemplates[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPolicyTemplate, name)
+	}
+	return template.generate(req)
+}
+
+// policyTemplatesFile is the format of the policy templates file, eg:
+//
+//	templates:
+//	  device_v1:
+//	    statements:
+//	      - actions: ["iot:Connect"]
+//	        resources: ["arn:aws:iot:${region}:${account}:client/${deviceId}"]
+type policyTemplatesFile struct {
+	Templates map[string]*policyTemplate `json:"templates" yaml:"templates"`
+}
+
+// policyTemplate is a policy defined in the policy templates file.
+type policyTemplate struct {
+	Statements []policyTemplateStatement `json:"statements" yaml:"statements"`
+}
+
+// policyTemplateStatement is a statement of a policy template. Its resources
+// may contain variables, which are substituted when the policy is generated.
+type policyTemplateStatement struct {
+	Effect    string   `json:"effect" yaml:"effect"`
+	Actions   []string `json:"actions" yaml:"actions"`
+	Resources []string `json:"resources" yaml:"resources"`
+}
+
+// loadPolicyTemplates loads the policy templates from the specified JSON or
+// YAML file. Templates in the file override built-in templates with the same
+// name.
+func loadPolicyTemplates(path string) error {
+	var templatesFile policyTemplatesFile
+	err := loadConfigFile(path, &templatesFile)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidPolicyTemplate, path, err)
+	}
+
+	// Validate all templates before any of them are used.
+	err = templatesFile.validate()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPolicyTemplate, err)
+	}
+
+	for _, name := range templatesFile.names() {
+		policyTemplates[name] = templatesFile.Templates[name]
+		iotLogger.Info("Loaded policy template.",
+			zap.String("Name:", name),
+			zap.String("Path:", path),
+		)
+	}
+	return nil
+}
+
+// validate checks that all templates in the file are valid. The built-in
+// policies that select a template cannot be overridden, since the topic
+// scheme and the handling of tokens without a management service would
+// silently no longer apply. The templates they select may be overridden
+// instead.
+func (f *policyTemplatesFile) validate() error {
+	for _, name := range f.names() {
+		if _, ok := policyTemplateSelectors[name]; ok {
+			return fmt.Errorf("%s: built-in policy cannot be overridden", name)
+		}
+		err := f.Templates[name].validate()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// names returns the sorted names of the templates in the file.
+func (f *policyTemplatesFile) names() []string {
+	names := make([]string, 0, len(f.Templates))
+	for name := range f.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validate checks that the policy template is well formed and only uses
+// supported variables.
+func (t *policyTemplate) validate() error {
+	if t == nil || len(t.Statements) == 0 {
+		return fmt.Errorf("no statements specified")
+	}
+
+	for i := range t.Statements {
+		statement := &t.Statements[i]
+		switch statement.Effect {
+		case "":
+			statement.Effect = policyEffectAllow
+		case policyEffectAllow, policyEffectDeny:
+		default:
+			return fmt.Errorf("statement %d: invalid effect: %s", i,
+				statement.Effect)
+		}
+
+		if len(statement.Actions) == 0 {
+			return fmt.Errorf("statement %d: no actions specified", i)
+		}
+		for _, action := range statement.Actions {
+			if !strings.HasPrefix(action, policyActionPrefix) {
+				return fmt.Errorf("statement %d: invalid action: %s", i, action)
+			}
+		}
+
+		if len(statement.Resources) == 0 {
+			return fmt.Errorf("statement %d: no resources specified", i)
+		}
+		for _, resource := range statement.Resources {
+			if !strings.HasPrefix(resource, policyResourcePrefix) {
+				return fmt.Errorf("statement %d: invalid resource: %s", i,
+					resource)
+			}
+			err := validatePolicyVariables(resource)
+			if err != nil {
+				return fmt.Errorf("statement %d: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validatePolicyVariables checks that the value only uses variables that are
+// supported in policy templates.
+func validatePolicyVariables(value string) error {
+	for _, match := range policyVariableRegex.FindAllStringSubmatch(value, -1) {
+		if !isPolicyVariable(match[1]) {
+			return fmt.Errorf("unknown variable: %s", match[0])
+		}
+	}
+	return nil
+}
+
+// isPolicyVariable checks whether the specified variable is supported in
+// policy templates.
+func isPolicyVariable(name string) bool {
+	switch name {
+	case policyVarSubject, policyVarRegion, policyVarAccount, policyVarDeviceID,
+		policyVarClientID, policyVarTenantID, policyVarMs:
+		return true
+	}
+	return false
+}
+
+// policyVariables returns the values of the variables that may be used in
+// policy templates for the client.
+func (req *policyRequest) policyVariables() map[string]string {
+	return map[string]string{
+		policyVarSubject:  req.claims.Subject,
+		policyVarRegion:   req.awsRegion,
+		policyVarAccount:  req.awsAccount,
+		policyVarDeviceID: req.claims.Subject,
+		policyVarClientID: req.clientID,
+		policyVarTenantID: req.claims.TenantID,
+		policyVarMs:       req.claims.ManagementService,
+	}
+}
+
+// generate renders the policy template for the client. Each variable used in
+// the template must have a value that can be safely used in a topic,
+// otherwise the policy is not generated.
+func (t *policyTemplate) generate(
+	req *policyRequest) ([]*events.IAMPolicyDocument, error) {
+	values := req.policyVariables()
+
+	var err error
+	render := func(match string) string {
+		name := policyVariableRegex.FindStringSubmatch(match)[1]
+		value := values[name]
+		if !isValidTopicLevel(value) && err == nil {
+			err = fmt.Errorf("%w: %s: %q", ErrInvalidTopicClaim, name, value)
+		}
+		return value
+	}
+
+	policyDoc := events.IAMPolicyDocument{
+		Version:   policyVersion,
+		Statement: make([]events.IAMPolicyStatement, 0, len(t.Statements)),
+	}
+	for _, statement := range t.Statements {
+		resources := make([]string, 0, len(statement.Resources))
+		for _, resource := range statement.Resources {
+			resources = append(resources,
+				policyVariableRegex.ReplaceAllStringFunc(resource, render))
+		}
+		policyDoc.Statement = append(policyDoc.Statement,
+			events.IAMPolicyStatement{
+				Action:   statement.Actions,
+				Effect:   statement.Effect,
+				Resource: resources,
+			})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []*events.IAMPolicyDocument{&policyDoc}, nil
+}
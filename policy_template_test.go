@@ -0,0 +1,366 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	testRegion  = "us-west-2"
+	testAccount = "111122223333"
+)
+
+// testStatement returns an allow statement for the action on the resources,
+// which are specified without the ARN prefix of the test region and account.
+func testStatement(action string, resources ...string) events.IAMPolicyStatement {
+	arns := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		arns = append(arns, "arn:aws:iot:"+testRegion+":"+testAccount+":"+resource)
+	}
+	return events.IAMPolicyStatement{
+		Action:   []string{action},
+		Effect:   policyEffectAllow,
+		Resource: arns,
+	}
+}
+
+// newTestPolicyRequest returns a policy request for a token of the specified
+// type, with the optional 'ms' and 'tid' claims.
+func newTestPolicyRequest(tokenType string, subject string, clientID string,
+	ms string, tid string) *policyRequest {
+	claims := &DstsTokenClaims{
+		TokenType:         tokenType,
+		ManagementService: ms,
+		TenantID:          tid,
+		Raw: map[string]interface{}{
+			"typ": tokenType,
+			"sub": subject,
+		},
+	}
+	claims.Subject = subject
+	if ms != "" {
+		claims.Raw["ms"] = ms
+	}
+	if tid != "" {
+		claims.Raw["tid"] = tid
+	}
+	return &policyRequest{
+		awsRegion:  testRegion,
+		awsAccount: testAccount,
+		clientID:   clientID,
+		claims:     claims,
+	}
+}
+
+// setPolicySettings sets the device topic scheme and the handling of tokens
+// without a management service for the duration of the test.
+func setPolicySettings(t *testing.T, scheme string, behavior string) {
+	oldScheme, oldBehavior := deviceTopicScheme, missingMsClaimBehavior
+	deviceTopicScheme, missingMsClaimBehavior = scheme, behavior
+	t.Cleanup(func() {
+		deviceTopicScheme, missingMsClaimBehavior = oldScheme, oldBehavior
+	})
+}
+
+func TestBuiltinDevicePolicy(t *testing.T) {
+	initLogger()
+	tests := []struct {
+		name     string
+		scheme   string
+		behavior string
+		ms       string
+		tid      string
+		want     []events.IAMPolicyStatement
+		wantErr  error
+	}{
+		{
+			name:     "v1",
+			scheme:   topicSchemeV1,
+			behavior: missingMsClaimNoBroadcast,
+			ms:       "hpcem",
+			tid:      "t1",
+			want: []events.IAMPolicyStatement{
+				testStatement("iot:Connect", "client/dev-1"),
+				testStatement("iot:Subscribe", "topicfilter/v1/dev-1/tasks",
+					"topicfilter/v1/@devices/hpcem"),
+				testStatement("iot:Receive", "topic/v1/dev-1/tasks",
+					"topic/v1/@devices/hpcem"),
+				testStatement("iot:Publish", "topic/v1/@cloud/hpcem/task_responses",
+					"topic/v1/@cloud/hpcem"),
+			},
+		},
+		{
+			name:     "v1 without ms",
+			scheme:   topicSchemeV1,
+			behavior: missingMsClaimNoBroadcast,
+			want: []events.IAMPolicyStatement{
+				testStatement("iot:Connect", "client/dev-1"),
+				testStatement("iot:Subscribe", "topicfilter/v1/dev-1/tasks"),
+				testStatement("iot:Receive", "topic/v1/dev-1/tasks"),
+			},
+		},
+		{
+			name:     "v1 without ms denied",
+			scheme:   topicSchemeV1,
+			behavior: missingMsClaimDeny,
+			wantErr:  ErrMissingMsClaim,
+		},
+		{
+			name:     "v1 with reserved ms",
+			scheme:   topicSchemeV1,
+			behavior: missingMsClaimNoBroadcast,
+			ms:       "quarantine",
+			wantErr:  ErrInvalidTopicClaim,
+		},
+		{
+			name:     "v2",
+			scheme:   topicSchemeV2,
+			behavior: missingMsClaimNoBroadcast,
+			ms:       "hpcem",
+			tid:      "t1",
+			want: []events.IAMPolicyStatement{
+				testStatement("iot:Connect", "client/dev-1"),
+				testStatement("iot:Subscribe", "topicfilter/v2/t1/dev-1/tasks",
+					"topicfilter/v2/t1/@devices/hpcem"),
+				testStatement("iot:Receive", "topic/v2/t1/dev-1/tasks",
+					"topic/v2/t1/@devices/hpcem"),
+				testStatement("iot:Publish",
+					"topic/v2/t1/@cloud/hpcem/task_responses",
+					"topic/v2/t1/@cloud/hpcem"),
+			},
+		},
+		{
+			name:     "v2 without tid",
+			scheme:   topicSchemeV2,
+			behavior: missingMsClaimNoBroadcast,
+			ms:       "hpcem",
+			wantErr:  ErrInvalidTopicClaim,
+		},
+		{
+			name:     "both without tid",
+			scheme:   topicSchemeBoth,
+			behavior: missingMsClaimNoBroadcast,
+			ms:       "hpcem",
+			want: []events.IAMPolicyStatement{
+				testStatement("iot:Connect", "client/dev-1"),
+				testStatement("iot:Subscribe", "topicfilter/v1/dev-1/tasks",
+					"topicfilter/v1/@devices/hpcem"),
+				testStatement("iot:Receive", "topic/v1/dev-1/tasks",
+					"topic/v1/@devices/hpcem"),
+				testStatement("iot:Publish", "topic/v1/@cloud/hpcem/task_responses",
+					"topic/v1/@cloud/hpcem"),
+			},
+		},
+		{
+			name:     "both without ms",
+			scheme:   topicSchemeBoth,
+			behavior: missingMsClaimNoBroadcast,
+			tid:      "t1",
+			want: []events.IAMPolicyStatement{
+				testStatement("iot:Connect", "client/dev-1"),
+				testStatement("iot:Subscribe", "topicfilter/v1/dev-1/tasks",
+					"topicfilter/v2/t1/dev-1/tasks"),
+				testStatement("iot:Receive", "topic/v1/dev-1/tasks",
+					"topic/v2/t1/dev-1/tasks"),
+			},
+		},
+		{
+			name:     "both with legacy publishing",
+			scheme:   topicSchemeBoth,
+			behavior: missingMsClaimLegacyPublish,
+			tid:      "t1",
+			want: []events.IAMPolicyStatement{
+				testStatement("iot:Connect", "client/dev-1"),
+				testStatement("iot:Subscribe", "topicfilter/v1/dev-1/tasks",
+					"topicfilter/v2/t1/dev-1/tasks"),
+				testStatement("iot:Receive", "topic/v1/dev-1/tasks",
+					"topic/v2/t1/dev-1/tasks"),
+				testStatement("iot:Publish", "topic/v1/@cloud/task_responses",
+					"topic/v1/@cloud", "topic/v2/t1/@cloud/task_responses",
+					"topic/v2/t1/@cloud"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setPolicySettings(t, tt.scheme, tt.behavior)
+			req := newTestPolicyRequest(TokenTypeDeviceAccessToken, "dev-1",
+				"dev-1", tt.ms, tt.tid)
+
+			docs, err := generatePolicy(policyTemplateDevice, req)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to generate the policy: %v", err)
+			}
+			if len(docs) != 1 || !reflect.DeepEqual(docs[0].Statement, tt.want) {
+				t.Errorf("unexpected policy:\n got: %+v\nwant: %+v", docs, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuiltinQuarantinePolicy(t *testing.T) {
+	v1 := []events.IAMPolicyStatement{
+		testStatement("iot:Connect", "client/dev-1"),
+		testStatement("iot:Subscribe", "topicfilter/v1/dev-1/quarantine"),
+		testStatement("iot:Receive", "topic/v1/dev-1/quarantine"),
+		testStatement("iot:Publish", "topic/v1/@cloud/quarantine/dev-1"),
+	}
+	tests := []struct {
+		name   string
+		scheme string
+		tid    string
+		want   []events.IAMPolicyStatement
+	}{
+		{"v1", topicSchemeV1, "t1", v1},
+		{"v2", topicSchemeV2, "t1", []events.IAMPolicyStatement{
+			testStatement("iot:Connect", "client/dev-1"),
+			testStatement("iot:Subscribe", "topicfilter/v2/t1/dev-1/quarantine"),
+			testStatement("iot:Receive", "topic/v2/t1/dev-1/quarantine"),
+			testStatement("iot:Publish", "topic/v2/t1/@cloud/quarantine/dev-1"),
+		}},
+		{"both", topicSchemeBoth, "t1", []events.IAMPolicyStatement{
+			testStatement("iot:Connect", "client/dev-1"),
+			testStatement("iot:Subscribe", "topicfilter/v1/dev-1/quarantine",
+				"topicfilter/v2/t1/dev-1/quarantine"),
+			testStatement("iot:Receive", "topic/v1/dev-1/quarantine",
+				"topic/v2/t1/dev-1/quarantine"),
+			testStatement("iot:Publish", "topic/v1/@cloud/quarantine/dev-1",
+				"topic/v2/t1/@cloud/quarantine/dev-1"),
+		}},
+		{"both without tid", topicSchemeBoth, "", v1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initLogger()
+			setPolicySettings(t, tt.scheme, missingMsClaimNoBroadcast)
+			req := newTestPolicyRequest(TokenTypeDeviceAccessToken, "dev-1",
+				"dev-1", "hpcem", tt.tid)
+			docs, err := generatePolicy(policyTemplateDeviceQuarantine, req)
+			if err != nil {
+				t.Fatalf("failed to generate the policy: %v", err)
+			}
+			if len(docs) != 1 || !reflect.DeepEqual(docs[0].Statement, tt.want) {
+				t.Errorf("unexpected policy:\n got: %+v\nwant: %+v", docs, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuiltinSchedulerPolicy(t *testing.T) {
+	setPolicySettings(t, topicSchemeV1, missingMsClaimNoBroadcast)
+	req := newTestPolicyRequest(TokenTypeAppAccessToken, schedulerAppID,
+		schedulerAppID+"-abc", "", "")
+	docs, err := generatePolicy(policyTemplateScheduler, req)
+	if err != nil {
+		t.Fatalf("failed to generate the policy: %v", err)
+	}
+
+	want := []events.IAMPolicyStatement{
+		testStatement("iot:Connect", "client/"+schedulerAppID+"-abc"),
+		testStatement("iot:Subscribe",
+			"topicfilter/v1/@cloud/quarantine/+",
+			"topicfilter/$share/krypton/v1/@cloud/quarantine/+",
+			"topicfilter/$share/krypton/v1/@cloud/+/task_responses",
+			"topicfilter/$share/krypton/v1/@cloud/+"),
+		testStatement("iot:Receive",
+			"topic/v1/@cloud/quarantine/*",
+			"topic/$share/krypton/v1/@cloud/quarantine/*",
+			"topic/v1/@cloud/*/task_responses",
+			"topic/$share/krypton/v1/@cloud/*/task_responses",
+			"topic/v1/@cloud/*",
+			"topic/$share/krypton/v1/@cloud/*"),
+		testStatement("iot:Publish",
+			"topic/v1/*/tasks",
+			"topic/v1/@devices/*",
+			"topic/v1/*/quarantine"),
+	}
+	if len(docs) != 1 || !reflect.DeepEqual(docs[0].Statement, want) {
+		t.Errorf("unexpected policy:\n got: %+v\nwant: %+v", docs, want)
+	}
+}
+
+// setPolicyTemplates restores the policy templates after the test.
+func setPolicyTemplates(t *testing.T) {
+	oldTemplates := make(map[string]*policyTemplate, len(policyTemplates))
+	for name, template := range policyTemplates {
+		oldTemplates[name] = template
+	}
+	t.Cleanup(func() {
+		policyTemplates = oldTemplates
+	})
+}
+
+func TestLoadPolicyTemplates(t *testing.T) {
+	initLogger()
+	setPolicyTemplates(t)
+	setPolicySettings(t, topicSchemeV1, missingMsClaimNoBroadcast)
+	dir := t.TempDir()
+	files := map[string]string{
+		"valid.yaml": "templates:\n" +
+			"  device_v1:\n" +
+			"    statements:\n" +
+			"      - actions: [\"iot:Connect\"]\n" +
+			"        resources: [\"arn:aws:iot:${region}:${account}:client/${deviceId}\"]\n",
+		"selector.yaml": "templates:\n" +
+			"  device:\n" +
+			"    statements:\n" +
+			"      - actions: [\"iot:Connect\"]\n" +
+			"        resources: [\"arn:aws:iot:${region}:${account}:client/${deviceId}\"]\n",
+		"unknown_variable.json": `{"templates": {"custom": {"statements": [{
+			"actions": ["iot:Connect"],
+			"resources": ["arn:aws:iot:${region}:${account}:client/${device}"]}]}}}`,
+		"invalid_action.json": `{"templates": {"custom": {"statements": [{
+			"actions": ["Connect"],
+			"resources": ["arn:aws:iot:${region}:${account}:client/${deviceId}"]}]}}}`,
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("failed to write the templates file: %v", err)
+		}
+	}
+
+	// Built-in policies that select a template cannot be overridden, and
+	// invalid templates are rejected.
+	for _, name := range []string{"selector.yaml", "unknown_variable.json",
+		"invalid_action.json"} {
+		err := loadPolicyTemplates(filepath.Join(dir, name))
+		if !errors.Is(err, ErrInvalidPolicyTemplate) {
+			t.Errorf("%s: expected ErrInvalidPolicyTemplate, got %v", name, err)
+		}
+	}
+
+	// Templates selected by the built-in policies may be overridden.
+	err := loadPolicyTemplates(filepath.Join(dir, "valid.yaml"))
+	if err != nil {
+		t.Fatalf("failed to load the templates: %v", err)
+	}
+	req := newTestPolicyRequest(TokenTypeDeviceAccessToken, "dev-1", "dev-1",
+		"hpcem", "t1")
+	docs, err := generatePolicy(policyTemplateDevice, req)
+	if err != nil {
+		t.Fatalf("failed to generate the policy: %v", err)
+	}
+	want := []events.IAMPolicyStatement{
+		testStatement("iot:Connect", "client/dev-1"),
+	}
+	if len(docs) != 1 || !reflect.DeepEqual(docs[0].Statement, want) {
+		t.Errorf("unexpected policy:\n got: %+v\nwant: %+v", docs, want)
+	}
+}
@@ -0,0 +1,25 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+// quarantinedDevices is the list of IDs of devices that have been flagged as
+// compromised. Quarantined devices are allowed to connect, but may only
+// receive remediation tasks. It is nil if no quarantine list is configured.
+var quarantinedDevices *refreshableList
+
+// isDeviceQuarantined checks whether the device is in the quarantine list.
+func isDeviceQuarantined(deviceID string) (bool, error) {
+	if quarantinedDevices == nil {
+		return false, nil
+	}
+	return quarantinedDevices.contains(deviceID)
+}
+
+// selectQuarantineTemplate selects the template of the policy issued to a
+// quarantined device, using the configured topic scheme.
+func selectQuarantineTemplate(req *policyRequest) (string, error) {
+	return policyTemplateDeviceQuarantine + "_" +
+		deviceTopicSchemeFor(req.claims), nil
+}
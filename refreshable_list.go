@@ -0,0 +1,251 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Default interval after which lists loaded from a file or HTTP endpoint
+	// are refreshed.
+	defaultListRefreshInterval = time.Minute * 5
+
+	// Handling of requests checked against a list that has not been loaded
+	// successfully since the lambda started.
+	listFailOpen   = "fail_open"
+	listFailClosed = "fail_closed"
+)
+
+// refreshableList is a set of values, such as revoked token IDs, loaded from a
+// local file or an HTTP endpoint. The list is refreshed in the background once
+// the refresh interval elapses, and the last successfully loaded list is used
+// if a refresh fails. Until the list has been loaded successfully, it is
+// treated as empty, or checks against it fail if the list fails closed. It is
+// safe for concurrent use.
+//
+// The list is either a JSON array of strings, or a text document with one
+// value per line. Empty lines and lines starting with '#' are ignored.
+type refreshableList struct {
+	// Name of the list, used in log messages.
+	name string
+
+	// Location of the list. Exactly one of these is specified.
+	file string
+	url  string
+
+	// HTTP client used to retrieve the list from the URL.
+	client *http.Client
+
+	// Interval after which the list is refreshed.
+	refreshInterval time.Duration
+
+	// Whether checks against the list fail until it is loaded successfully.
+	failClosed bool
+
+	// Protects the fields below.
+	lock sync.RWMutex
+
+	// Values in the list.
+	entries map[string]struct{}
+
+	// Set once the list has been loaded successfully.
+	loaded bool
+
+	// Time at which the list must be refreshed.
+	expiresAt time.Time
+
+	// Set while a refresh of the list is in progress.
+	refreshing bool
+}
+
+// newRefreshableList creates a list loaded from the specified file or URL. If
+// neither is specified, no list is configured and nil is returned. If the
+// list cannot be loaded initially, before the deadline of the context, it is
+// retried in the background. Until then, the list is treated as empty if the
+// failure mode is fail_open, and checks against it fail if it is fail_closed.
+func newRefreshableList(ctx context.Context, name string, file string,
+	url string, refreshInterval time.Duration,
+	failureMode string) (*refreshableList, error) {
+	if file == "" && url == "" {
+		return nil, nil
+	}
+	if file != "" && url != "" {
+		return nil, fmt.Errorf("%w: %s: specify either a file or a URL",
+			ErrInvalidListConfig, name)
+	}
+	if failureMode != listFailOpen && failureMode != listFailClosed {
+		return nil, fmt.Errorf("%w: %s: invalid failure mode: %s",
+			ErrInvalidListConfig, name, failureMode)
+	}
+
+	list := &refreshableList{
+		name:            name,
+		file:            file,
+		url:             url,
+		client:          newServiceHttpClient(defaultHttpRequestTimeout),
+		refreshInterval: refreshInterval,
+		failClosed:      failureMode == listFailClosed,
+		entries:         map[string]struct{}{},
+	}
+	err := list.refresh(ctx)
+	if err != nil {
+		message := "Failed to load list. It is treated as empty until it is loaded in the background!"
+		if list.failClosed {
+			message = "Failed to load list. Requests checked against it are denied until it is loaded in the background!"
+		}
+		iotLogger.Error(message,
+			zap.String("List:", name),
+			zap.Error(err),
+		)
+	}
+	return list, nil
+}
+
+// contains checks whether the value is in the list. If the list has expired,
+// a background refresh is triggered and the current list is used to service
+// this request. If the list fails closed and has not been loaded yet,
+// ErrListUnavailable is returned.
+func (l *refreshableList) contains(value string) (bool, error) {
+	l.lock.RLock()
+	_, ok := l.entries[value]
+	unavailable := l.failClosed && !l.loaded
+	expired := time.Now().After(l.expiresAt)
+	l.lock.RUnlock()
+
+	if expired {
+		l.refreshInBackground()
+	}
+	if unavailable {
+		return false, fmt.Errorf("%w: %s", ErrListUnavailable, l.name)
+	}
+	return ok, nil
+}
+
+// refreshInBackground starts a refresh of the list, unless one is already in
+// progress.
+func (l *refreshableList) refreshInBackground() {
+	l.lock.Lock()
+	if l.refreshing {
+		l.lock.Unlock()
+		return
+	}
+	l.refreshing = true
+	l.lock.Unlock()
+
+	go func() {
+		err := l.refresh(context.Background())
+		if err != nil {
+			iotLogger.Error("Background refresh of list failed. Continuing with cached list!",
+				zap.String("List:", l.name),
+				zap.Error(err),
+			)
+		}
+
+		l.lock.Lock()
+		l.refreshing = false
+		l.lock.Unlock()
+	}()
+}
+
+// refresh loads the list and replaces the cached list with it. If the list
+// could not be loaded, the cached list is retained and the refresh is retried
+// after a short interval.
+func (l *refreshableList) refresh(ctx context.Context) error {
+	var listBytes []byte
+	var err error
+	if l.file != "" {
+		listBytes, err = os.ReadFile(l.file)
+	} else {
+		listBytes, err = l.fetch(ctx)
+	}
+
+	var entries map[string]struct{}
+	if err == nil {
+		entries, err = parseList(listBytes)
+	}
+	if err != nil {
+		l.lock.Lock()
+		l.expiresAt = time.Now().Add(jwksRefreshRetryInterval)
+		l.lock.Unlock()
+		return err
+	}
+
+	l.lock.Lock()
+	l.entries = entries
+	l.loaded = true
+	l.expiresAt = time.Now().Add(l.refreshInterval)
+	l.lock.Unlock()
+
+	iotLogger.Debug("Refreshed list.",
+		zap.String("List:", l.name),
+		zap.Int("Entry count:", len(entries)),
+	)
+	return nil
+}
+
+// fetch retrieves the list from its URL.
+func (l *refreshableList) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(headerUserAgent, authorizerUserAgent)
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{
+			URL:        l.url,
+			StatusCode: resp.StatusCode,
+		}
+	}
+	return readLimitedBody(resp, l.url)
+}
+
+// parseList parses a JSON array of strings or a text document with one value
+// per line.
+func parseList(listBytes []byte) (map[string]struct{}, error) {
+	entries := map[string]struct{}{}
+
+	if bytes.HasPrefix(bytes.TrimSpace(listBytes), []byte("[")) {
+		var values []string
+		err := json.Unmarshal(listBytes, &values)
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range values {
+			if value != "" {
+				entries[value] = struct{}{}
+			}
+		}
+		return entries, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(listBytes))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries[line] = struct{}{}
+	}
+	return entries, scanner.Err()
+}
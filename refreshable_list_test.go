@@ -0,0 +1,70 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefreshableListFailureMode(t *testing.T) {
+	initLogger()
+	available := new(atomic.Bool)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if !available.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte("# Revoked tokens\ntoken-1\n"))
+		}))
+	t.Cleanup(server.Close)
+
+	// A list that cannot be loaded is treated as empty if it fails open.
+	list, err := newRefreshableList(context.Background(), "test", "",
+		server.URL, time.Hour, listFailOpen)
+	if err != nil {
+		t.Fatalf("failed to configure the list: %v", err)
+	}
+	found, err := list.contains("token-1")
+	if found || err != nil {
+		t.Errorf("expected an empty list, got %v, %v", found, err)
+	}
+
+	// Checks against a list that cannot be loaded fail if it fails closed.
+	list, err = newRefreshableList(context.Background(), "test", "",
+		server.URL, time.Hour, listFailClosed)
+	if err != nil {
+		t.Fatalf("failed to configure the list: %v", err)
+	}
+	_, err = list.contains("token-1")
+	if !errors.Is(err, ErrListUnavailable) {
+		t.Errorf("expected ErrListUnavailable, got %v", err)
+	}
+
+	// Once loaded, the list is used and the failure mode no longer applies.
+	available.Store(true)
+	err = list.refresh(context.Background())
+	if err != nil {
+		t.Fatalf("failed to refresh the list: %v", err)
+	}
+	for value, want := range map[string]bool{"token-1": true, "token-2": false} {
+		found, err = list.contains(value)
+		if found != want || err != nil {
+			t.Errorf("%s: expected %v, got %v, %v", value, want, found, err)
+		}
+	}
+
+	_, err = newRefreshableList(context.Background(), "test", "",
+		server.URL, time.Hour, "fail_sometimes")
+	if !errors.Is(err, ErrInvalidListConfig) {
+		t.Errorf("expected ErrInvalidListConfig, got %v", err)
+	}
+}
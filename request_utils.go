@@ -4,7 +4,15 @@
 // (C) HP Development Company, LP
 package main
 
-import "net/url"
+import (
+	"net/url"
+	"strings"
+)
+
+// Characters that may not appear in a value used as a topic level in an IoT
+// policy: the MQTT topic level separator and wildcards, the IoT policy
+// wildcards, and the '$' that introduces IoT policy variables.
+const invalidTopicLevelChars = "/+#*?$"
 
 // Check if the list of protocols sent by the broker for the event contains
 // the specified protocol.
@@ -17,6 +25,16 @@ func containsProtocol(protocols *[]string, matchProtocol string) bool {
 	return false
 }
 
+// Check if the list of strings contains the specified value.
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
 // Extract the specified query parameter from the parsed URL map. If the parameter
 // does not exist, return an empty string.
 // Eg: For MQTT connect requests, the username field contains a list of parameters,
@@ -28,3 +46,9 @@ func getQueryParameter(values url.Values, parameterName string) string {
 	}
 	return value[0]
 }
+
+// Check if the value, eg: the tenant ID of a device, is non-empty and can be
+// safely used as a single level of a topic in an IoT policy.
+func isValidTopicLevel(value string) bool {
+	return value != "" && !strings.ContainsAny(value, invalidTopicLevelChars)
+}
@@ -0,0 +1,35 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// revokedTokens is the denylist of token IDs ('jti' claim) of access tokens
+// that were revoked before they expired, eg: because they leaked. It is nil
+// if no denylist is configured.
+var revokedTokens *refreshableList
+
+// checkTokenRevocation rejects the token if its ID is in the denylist of
+// revoked tokens.
+func checkTokenRevocation(claims *DstsTokenClaims) error {
+	if revokedTokens == nil || claims.ID == "" {
+		return nil
+	}
+
+	revoked, err := revokedTokens.contains(claims.ID)
+	if err != nil {
+		auditDenied(auditReasonListUnavailable, claims, zap.Error(err))
+		return err
+	}
+	if revoked {
+		auditDenied(auditReasonTokenRevoked, claims)
+		return fmt.Errorf("%w: %s", ErrTokenRevoked, claims.ID)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+)
+
+// Variables available to the CEL expressions of rule conditions.
+const (
+	// Map of all claims in the access token, eg: claims.sub.
+	celVarClaims = "claims"
+
+	// Map of the attributes of the connection request: clientId, protocols,
+	// serverName, region and account.
+	celVarRequest = "request"
+)
+
+// Maximum cost of evaluating a rule condition, which bounds the time spent
+// evaluating expressions such as loops over large lists.
+const celCostLimit = 100000
+
+var (
+	// CEL environment in which rule conditions are compiled.
+	celEnv     *cel.Env
+	celEnvErr  error
+	celEnvOnce sync.Once
+)
+
+// ruleCondition is a Common Expression Language (CEL) expression that
+// requests matching an authorization rule must meet, eg:
+//
+//	request.clientId == claims.sub ||
+//	  request.clientId.matches('^' + claims.sub + '-[a-z0-9]{1,8}$')
+//
+// https://github.com/google/cel-spec
+type ruleCondition struct {
+	// CEL expression, which must evaluate to a boolean.
+	Expression string `json:"expression" yaml:"expression"`
+
+	// Reason recorded in the audit log entry when a request is denied because
+	// it doesn't meet the condition.
+	DenyReason string `json:"deny_reason" yaml:"deny_reason"`
+
+	// Compiled expression.
+	program cel.Program
+}
+
+// getCelEnv returns the CEL environment in which rule conditions are
+// compiled.
+func getCelEnv() (*cel.Env, error) {
+	celEnvOnce.Do(func() {
+		celEnv, celEnvErr = cel.NewEnv(
+			cel.Variable(celVarClaims, cel.MapType(cel.StringType, cel.DynType)),
+			cel.Variable(celVarRequest, cel.MapType(cel.StringType, cel.DynType)),
+			cel.CrossTypeNumericComparisons(true),
+		)
+	})
+	return celEnv, celEnvErr
+}
+
+// compile parses and type checks the expression of the condition.
+func (c *ruleCondition) compile() error {
+	if c == nil || c.Expression == "" {
+		return fmt.Errorf("no expression specified")
+	}
+
+	env, err := getCelEnv()
+	if err != nil {
+		return err
+	}
+
+	ast, issues := env.Compile(c.Expression)
+	if issues != nil && issues.Err() != nil {
+		return issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return fmt.Errorf("expression must evaluate to a bool, not %v",
+			ast.OutputType())
+	}
+
+	c.program, err = env.Program(ast, cel.CostLimit(celCostLimit))
+	if err != nil {
+		return err
+	}
+
+	if c.DenyReason == "" {
+		c.DenyReason = "condition not met: " + c.Expression
+	}
+	return nil
+}
+
+// celActivation returns the values of the variables available to rule
+// conditions for the request.
+func (req *policyRequest) celActivation() map[string]interface{} {
+	claims := req.claims.Raw
+	if claims == nil {
+		claims = map[string]interface{}{}
+	}
+
+	protocols := req.protocols
+	if protocols == nil {
+		protocols = []string{}
+	}
+
+	return map[string]interface{}{
+		celVarClaims: claims,
+		celVarRequest: map[string]interface{}{
+			"clientId":   req.clientID,
+			"protocols":  protocols,
+			"serverName": req.serverName,
+			"region":     req.awsRegion,
+			"account":    req.awsAccount,
+		},
+	}
+}
+
+// checkConditions evaluates the conditions of the rule for the request. If
+// the request doesn't meet a condition, or the condition cannot be evaluated,
+// eg: because it references a claim that isn't in the token, an error with
+// the deny reason of the condition is returned.
+func (r *authorizationRule) checkConditions(req *policyRequest) error {
+	if len(r.Conditions) == 0 {
+		return nil
+	}
+
+	activation := req.celActivation()
+	for _, condition := range r.Conditions {
+		result, _, err := condition.program.Eval(activation)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrConditionNotMet,
+				condition.DenyReason, err)
+		}
+
+		if allowed, ok := result.Value().(bool); !ok || !allowed {
+			return fmt.Errorf("%w: %s", ErrConditionNotMet,
+				condition.DenyReason)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// newTestConditionRule returns a rule with the compiled conditions.
+func newTestConditionRule(t *testing.T,
+	conditions ...*ruleCondition) *authorizationRule {
+	t.Helper()
+	for _, condition := range conditions {
+		err := condition.compile()
+		if err != nil {
+			t.Fatalf("failed to compile %q: %v", condition.Expression, err)
+		}
+	}
+	return &authorizationRule{Name: "test", Conditions: conditions}
+}
+
+func TestRuleConditions(t *testing.T) {
+	rule := newTestConditionRule(t,
+		&ruleCondition{Expression: "claims.tid == 't1'"},
+		&ruleCondition{
+			Expression: "request.clientId == claims.sub",
+			DenyReason: "client ID must be the device ID",
+		})
+
+	// Requests meeting all conditions are allowed.
+	err := rule.checkConditions(newTestPolicyRequest(TokenTypeDeviceAccessToken,
+		"dev-1", "dev-1", "hpcem", "t1"))
+	if err != nil {
+		t.Errorf("expected the request to be allowed, got %v", err)
+	}
+
+	// Requests are denied with the deny reason of the condition they don't
+	// meet, or the expression if it has no deny reason.
+	tests := []struct {
+		name       string
+		clientID   string
+		tid        string
+		wantReason string
+	}{
+		{"deny reason", "dev-2", "t1", "client ID must be the device ID"},
+		{"default deny reason", "dev-1", "t2", "claims.tid == 't1'"},
+	}
+	for _, tt := range tests {
+		err = rule.checkConditions(newTestPolicyRequest(
+			TokenTypeDeviceAccessToken, "dev-1", tt.clientID, "hpcem", tt.tid))
+		if !errors.Is(err, ErrConditionNotMet) ||
+			!strings.Contains(err.Error(), tt.wantReason) {
+			t.Errorf("%s: expected a denial with reason %q, got %v", tt.name,
+				tt.wantReason, err)
+		}
+	}
+}
+
+func TestRuleConditionFailsClosed(t *testing.T) {
+	// Conditions that cannot be evaluated deny the request, eg: because they
+	// reference a claim that isn't in the token.
+	rule := newTestConditionRule(t, &ruleCondition{
+		Expression: "claims.license != 'expired'",
+		DenyReason: "license expired",
+	})
+	err := rule.checkConditions(newTestPolicyRequest(TokenTypeDeviceAccessToken,
+		"dev-1", "dev-1", "hpcem", "t1"))
+	if !errors.Is(err, ErrConditionNotMet) ||
+		!strings.Contains(err.Error(), "license expired") {
+		t.Errorf("expected a denial, got %v", err)
+	}
+
+	// Conditions whose evaluation exceeds the cost limit deny the request.
+	rule = newTestConditionRule(t, &ruleCondition{
+		Expression: "claims.groups.all(x, claims.groups.all(y, x == y || true))",
+	})
+	groups := make([]interface{}, 1000)
+	for i := range groups {
+		groups[i] = "group"
+	}
+	req := newTestPolicyRequest(TokenTypeDeviceAccessToken, "dev-1", "dev-1",
+		"hpcem", "t1")
+	req.claims.Raw["groups"] = groups
+	err = rule.checkConditions(req)
+	if !errors.Is(err, ErrConditionNotMet) ||
+		!strings.Contains(err.Error(), "cost limit") {
+		t.Errorf("expected a denial due to the cost limit, got %v", err)
+	}
+}
+
+func TestInvalidRuleConditions(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+	}{
+		{"no expression", ""},
+		{"syntax error", "claims.sub =="},
+		{"undeclared variable", "device.id == 'dev-1'"},
+		{"not a bool", "claims.sub + '-suffix'"},
+	}
+	for _, tt := range tests {
+		condition := &ruleCondition{Expression: tt.expression}
+		if condition.compile() == nil {
+			t.Errorf("%s: expected compilation to fail", tt.name)
+		}
+	}
+
+	// Rules with conditions that fail to compile are rejected when they are
+	// loaded.
+	rule := &authorizationRule{
+		Name:           "test",
+		Conditions:     []*ruleCondition{{Expression: "claims.sub =="}},
+		PolicyTemplate: policyTemplateDevice,
+	}
+	if rule.validate() == nil {
+		t.Errorf("expected the rule to be rejected")
+	}
+}
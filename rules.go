@@ -0,0 +1,374 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Effects of authorization rules.
+const (
+	ruleEffectAllow = "allow"
+	ruleEffectDeny  = "deny"
+)
+
+// Default format of the principal ID of authenticated clients. Characters
+// other than letters and digits are removed from the principal ID.
+const defaultPrincipalIDFormat = "${clientId}"
+
+// Maximum length of the principal ID returned to AWS IoT Core.
+const maxPrincipalIDLength = 128
+
+// Maximum number of compiled client ID patterns cached, and the duration for
+// which they are cached. Patterns that use variables are compiled for each
+// client after the variables are replaced with the values for the client.
+const (
+	maxClientIDRegexCacheSize = 10000
+	clientIDRegexCacheTTL     = time.Hour
+)
+
+// clientIDRegexCache caches compiled client ID patterns, indexed by the
+// pattern after its variables are replaced.
+var clientIDRegexCache = newLruCache(maxClientIDRegexCacheSize)
+
+// authorizationRule selects how connection requests matching it are handled.
+// Rules are evaluated in order, and the first matching rule is applied.
+type authorizationRule struct {
+	// Name of the rule, recorded in log and audit log entries.
+	Name string `json:"name" yaml:"name"`
+
+	// Conditions that connection requests must meet to match the rule.
+	Match authorizationRuleMatch `json:"match" yaml:"match"`
+
+	// Whether matching requests are allowed (default) or denied.
+	Effect string `json:"effect" yaml:"effect"`
+
+	// CEL conditions that requests matching the rule must meet to be
+	// allowed. Requests that don't meet a condition are denied.
+	Conditions []*ruleCondition `json:"conditions" yaml:"conditions"`
+
+	// Name of the policy template used to generate the policy for matching
+	// requests. Required if the rule allows requests.
+	PolicyTemplate string `json:"policy_template" yaml:"policy_template"`
+
+	// Intervals after which the policy is refreshed and after which the
+	// client is disconnected. Default to an hour.
+	RefreshAfterSeconds    uint32 `json:"refresh_after_seconds" yaml:"refresh_after_seconds"`
+	DisconnectAfterSeconds uint32 `json:"disconnect_after_seconds" yaml:"disconnect_after_seconds"`
+
+	// Format of the principal ID of the client, which may contain the same
+	// variables as policy templates. Defaults to the client ID.
+	PrincipalID string `json:"principal_id" yaml:"principal_id"`
+}
+
+// authorizationRuleMatch contains the conditions that connection requests
+// must meet to match a rule. Conditions that are not specified are not
+// checked. A condition that lists several values is met if any of them
+// matches.
+type authorizationRuleMatch struct {
+	// Token claims.
+	TokenTypes         []string            `json:"token_types" yaml:"token_types"`
+	Subjects           []string            `json:"subjects" yaml:"subjects"`
+	TenantIDs          []string            `json:"tenant_ids" yaml:"tenant_ids"`
+	ManagementServices []string            `json:"management_services" yaml:"management_services"`
+	Claims             map[string][]string `json:"claims" yaml:"claims"`
+
+	// Request attributes. The client ID is matched against a regular
+	// expression, which may contain the same variables as policy templates,
+	// eg: ^${sub}$.
+	Protocols   []string `json:"protocols" yaml:"protocols"`
+	ClientID    string   `json:"client_id" yaml:"client_id"`
+	ServerNames []string `json:"server_names" yaml:"server_names"`
+}
+
+// authorizationRulesFile is the format of the authorization rules file.
+type authorizationRulesFile struct {
+	Rules []*authorizationRule `json:"rules" yaml:"rules"`
+}
+
+// builtinAuthorizationRules authorize devices to connect using their device
+// ID as the client ID, and the scheduler to connect using a client ID that
+// starts with its app ID.
+var builtinAuthorizationRules = []*authorizationRule{
+	{
+		Name: "device",
+		Match: authorizationRuleMatch{
+			TokenTypes: []string{TokenTypeDeviceAccessToken},
+			ClientID:   "^${sub}$",
+		},
+		Effect:                 ruleEffectAllow,
+		PolicyTemplate:         policyTemplateDevice,
+		RefreshAfterSeconds:    defaultRefreshAfterSeconds,
+		DisconnectAfterSeconds: defaultDisconnectAfterSeconds,
+		PrincipalID:            "${deviceId}",
+	},
+	{
+		// The client ID of the scheduler may contain a short unique string
+		// after its app ID, so that multiple scheduler pods can connect to
+		// the broker without causing each other to be disconnected due to
+		// IoT core's client ID uniqueness requirements.
+		Name: "scheduler",
+		Match: authorizationRuleMatch{
+			TokenTypes: []string{TokenTypeAppAccessToken},
+			Subjects:   []string{schedulerAppID},
+			ClientID:   "^${sub}",
+		},
+		Effect:                 ruleEffectAllow,
+		PolicyTemplate:         policyTemplateScheduler,
+		RefreshAfterSeconds:    defaultRefreshAfterSeconds,
+		DisconnectAfterSeconds: defaultDisconnectAfterSeconds,
+		PrincipalID:            "${clientId}",
+	},
+}
+
+// Ordered list of authorization rules. Requests that match none of the rules
+// are denied.
+var authorizationRules = builtinAuthorizationRules
+
+// loadAuthorizationRules loads the ordered list of authorization rules from
+// the specified JSON or YAML file. The rules replace the built-in rules.
+// Policy templates must be loaded before the rules that use them.
+func loadAuthorizationRules(path string) error {
+	var rulesFile authorizationRulesFile
+	err := loadConfigFile(path, &rulesFile)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidAuthorizationRule, path, err)
+	}
+	if len(rulesFile.Rules) == 0 {
+		return fmt.Errorf("%w: %s: no rules specified",
+			ErrInvalidAuthorizationRule, path)
+	}
+
+	names := map[string]bool{}
+	for i, rule := range rulesFile.Rules {
+		if rule == nil || rule.Name == "" {
+			return fmt.Errorf("%w: rule %d: no name specified",
+				ErrInvalidAuthorizationRule, i)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("%w: %s: duplicate rule name",
+				ErrInvalidAuthorizationRule, rule.Name)
+		}
+		names[rule.Name] = true
+
+		err = rule.validate()
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidAuthorizationRule,
+				rule.Name, err)
+		}
+	}
+
+	authorizationRules = rulesFile.Rules
+	iotLogger.Info("Loaded authorization rules.",
+		zap.String("Path:", path),
+		zap.Int("Rule count:", len(authorizationRules)),
+	)
+	return nil
+}
+
+// validate checks that the rule is well formed and sets the defaults of
+// settings that are not specified.
+func (r *authorizationRule) validate() error {
+	switch r.Effect {
+	case "":
+		r.Effect = ruleEffectAllow
+	case ruleEffectAllow, ruleEffectDeny:
+	default:
+		return fmt.Errorf("invalid effect: %s", r.Effect)
+	}
+
+	if r.Match.ClientID != "" {
+		err := validatePolicyVariables(r.Match.ClientID)
+		if err != nil {
+			return fmt.Errorf("client_id: %v", err)
+		}
+		_, err = regexp.Compile(policyVariableRegex.ReplaceAllString(
+			r.Match.ClientID, "x"))
+		if err != nil {
+			return fmt.Errorf("client_id: %v", err)
+		}
+	}
+
+	for i, condition := range r.Conditions {
+		err := condition.compile()
+		if err != nil {
+			return fmt.Errorf("condition %d: %v", i, err)
+		}
+	}
+
+	if r.Effect == ruleEffectDeny {
+		return nil
+	}
+
+	if r.PolicyTemplate == "" {
+		return fmt.Errorf("no policy template specified")
+	}
+	if !isPolicyTemplate(r.PolicyTemplate) {
+		return fmt.Errorf("%w: %s", ErrUnknownPolicyTemplate, r.PolicyTemplate)
+	}
+
+	if r.RefreshAfterSeconds == 0 {
+		r.RefreshAfterSeconds = defaultRefreshAfterSeconds
+	}
+	if r.DisconnectAfterSeconds == 0 {
+		r.DisconnectAfterSeconds = defaultDisconnectAfterSeconds
+	}
+	if r.RefreshAfterSeconds < minRefreshAfterSeconds ||
+		r.RefreshAfterSeconds > maxRefreshAfterSeconds {
+		return fmt.Errorf("refresh_after_seconds must be between %d and %d",
+			minRefreshAfterSeconds, maxRefreshAfterSeconds)
+	}
+	if r.DisconnectAfterSeconds < minDisconnectAfterSeconds ||
+		r.DisconnectAfterSeconds > maxDisconnectAfterSeconds {
+		return fmt.Errorf("disconnect_after_seconds must be between %d and %d",
+			minDisconnectAfterSeconds, maxDisconnectAfterSeconds)
+	}
+
+	if r.PrincipalID == "" {
+		r.PrincipalID = defaultPrincipalIDFormat
+	}
+	return validatePolicyVariables(r.PrincipalID)
+}
+
+// findAuthorizationRule returns the first authorization rule matching the
+// request, or nil if no rule matches it.
+func findAuthorizationRule(req *policyRequest) *authorizationRule {
+	for _, rule := range authorizationRules {
+		if rule.matches(req) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// matches checks whether the request meets all conditions of the rule.
+func (r *authorizationRule) matches(req *policyRequest) bool {
+	m := &r.Match
+	claims := req.claims
+	if !matchesAny(m.TokenTypes, claims.TokenType) ||
+		!matchesAny(m.Subjects, claims.Subject) ||
+		!matchesAny(m.TenantIDs, claims.TenantID) ||
+		!matchesAny(m.ManagementServices, claims.ManagementService) {
+		return false
+	}
+
+	for name, values := range m.Claims {
+		if !claimMatchesAny(claims.Raw[name], values) {
+			return false
+		}
+	}
+
+	if len(m.Protocols) != 0 {
+		matched := false
+		for _, protocol := range req.protocols {
+			if containsString(m.Protocols, protocol) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if !matchesAny(m.ServerNames, req.serverName) {
+		return false
+	}
+
+	if m.ClientID != "" {
+		// Variables in the client ID pattern are matched literally. A pattern
+		// that uses a variable with no value doesn't match.
+		values := req.policyVariables()
+		missingValue := false
+		pattern := policyVariableRegex.ReplaceAllStringFunc(m.ClientID,
+			func(match string) string {
+				value := values[policyVariableRegex.FindStringSubmatch(match)[1]]
+				if value == "" {
+					missingValue = true
+				}
+				return regexp.QuoteMeta(value)
+			})
+		if missingValue {
+			return false
+		}
+
+		clientIDRegex, err := compileClientIDPattern(pattern)
+		if err != nil || !clientIDRegex.MatchString(req.clientID) {
+			return false
+		}
+	}
+	return true
+}
+
+// compileClientIDPattern returns the compiled client ID pattern, compiling it
+// if it is not cached.
+func compileClientIDPattern(pattern string) (*regexp.Regexp, error) {
+	if cached, ok := clientIDRegexCache.get(pattern); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+
+	clientIDRegex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	clientIDRegexCache.add(pattern, clientIDRegex,
+		time.Now().Add(clientIDRegexCacheTTL))
+	return clientIDRegex, nil
+}
+
+// matchesAny checks whether the value is one of the specified values. If no
+// values are specified, any value matches.
+func matchesAny(values []string, value string) bool {
+	return len(values) == 0 || containsString(values, value)
+}
+
+// claimMatchesAny checks whether the value of a custom claim is one of the
+// specified values. If the claim is an array, any of its elements may match.
+func claimMatchesAny(claim interface{}, values []string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return containsString(values, claim)
+	case float64:
+		return containsString(values, strconv.FormatFloat(claim, 'f', -1, 64))
+	case bool:
+		return containsString(values, strconv.FormatBool(claim))
+	case []interface{}:
+		for _, item := range claim {
+			if claimMatchesAny(item, values) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// principalID returns the principal ID of the client formatted as specified
+// by the rule. AWS IoT Core requires principal IDs to be alphanumeric, so all
+// other characters are removed.
+func (r *authorizationRule) principalID(req *policyRequest) (string, error) {
+	values := req.policyVariables()
+	principalID := policyVariableRegex.ReplaceAllStringFunc(r.PrincipalID,
+		func(match string) string {
+			return values[policyVariableRegex.FindStringSubmatch(match)[1]]
+		})
+
+	principalID = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') {
+			return r
+		}
+		return -1
+	}, principalID)
+	if principalID == "" || len(principalID) > maxPrincipalIDLength {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPrincipalID, principalID)
+	}
+	return principalID, nil
+}
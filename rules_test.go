@@ -0,0 +1,129 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setAuthorizationRules restores the authorization rules after the test.
+func setAuthorizationRules(t *testing.T) {
+	oldRules := authorizationRules
+	t.Cleanup(func() {
+		authorizationRules = oldRules
+	})
+}
+
+// findTestRule returns the name of the rule matching a request for a token
+// of the specified type, or an empty string if no rule matches it.
+func findTestRule(tokenType string, subject string, clientID string) string {
+	rule := findAuthorizationRule(newTestPolicyRequest(tokenType, subject,
+		clientID, "hpcem", "t1"))
+	if rule == nil {
+		return ""
+	}
+	return rule.Name
+}
+
+func TestAuthorizationRuleOrder(t *testing.T) {
+	initLogger()
+	setAuthorizationRules(t)
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	err := os.WriteFile(path, []byte("rules:\n"+
+		"  - name: blocked\n"+
+		"    match:\n"+
+		"      subjects: [dev-2]\n"+
+		"    effect: deny\n"+
+		"  - name: device\n"+
+		"    match:\n"+
+		"      token_types: [device]\n"+
+		"      client_id: ^${sub}$\n"+
+		"    policy_template: device\n"+
+		"  - name: device-any-client\n"+
+		"    match:\n"+
+		"      token_types: [device]\n"+
+		"    policy_template: device_quarantine\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write the rules file: %v", err)
+	}
+	err = loadAuthorizationRules(path)
+	if err != nil {
+		t.Fatalf("failed to load the rules: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		tokenType string
+		subject   string
+		clientID  string
+		wantRule  string
+	}{
+		{"first match", TokenTypeDeviceAccessToken, "dev-2", "dev-2", "blocked"},
+		{"second rule", TokenTypeDeviceAccessToken, "dev-1", "dev-1", "device"},
+		{"other client ID", TokenTypeDeviceAccessToken, "dev-1", "dev-2",
+			"device-any-client"},
+		{"no matching rule", TokenTypeAppAccessToken, schedulerAppID,
+			schedulerAppID, ""},
+	}
+	for _, tt := range tests {
+		rule := findTestRule(tt.tokenType, tt.subject, tt.clientID)
+		if rule != tt.wantRule {
+			t.Errorf("%s: expected rule %q, got %q", tt.name, tt.wantRule, rule)
+		}
+	}
+}
+
+func TestBuiltinAuthorizationRules(t *testing.T) {
+	setAuthorizationRules(t)
+	authorizationRules = builtinAuthorizationRules
+
+	tests := []struct {
+		name      string
+		tokenType string
+		subject   string
+		clientID  string
+		wantRule  string
+	}{
+		{"device", TokenTypeDeviceAccessToken, "dev-1", "dev-1", "device"},
+		{"device ID as prefix", TokenTypeDeviceAccessToken, "dev-1", "dev-12", ""},
+		{"no subject", TokenTypeDeviceAccessToken, "", "", ""},
+
+		// Metacharacters in the subject are matched literally.
+		{"dot in subject", TokenTypeDeviceAccessToken, "dev.1", "dev.1", "device"},
+		{"dot as wildcard", TokenTypeDeviceAccessToken, "dev.1", "devx1", ""},
+		{"plus as repetition", TokenTypeDeviceAccessToken, "dev+", "devvv", ""},
+		{"alternation", TokenTypeDeviceAccessToken, "dev-1|.*", "dev-2", ""},
+
+		{"scheduler", TokenTypeAppAccessToken, schedulerAppID,
+			schedulerAppID + "-abc", "scheduler"},
+		{"scheduler ID not as prefix", TokenTypeAppAccessToken, schedulerAppID,
+			"x" + schedulerAppID, ""},
+		{"other app", TokenTypeAppAccessToken, "other-app", "other-app", ""},
+	}
+	for _, tt := range tests {
+		rule := findTestRule(tt.tokenType, tt.subject, tt.clientID)
+		if rule != tt.wantRule {
+			t.Errorf("%s: expected rule %q, got %q", tt.name, tt.wantRule, rule)
+		}
+	}
+}
+
+func TestClientIDPatternCache(t *testing.T) {
+	first, err := compileClientIDPattern("^dev-1$")
+	if err != nil {
+		t.Fatalf("failed to compile the pattern: %v", err)
+	}
+	second, err := compileClientIDPattern("^dev-1$")
+	if err != nil || second != first {
+		t.Errorf("expected the compiled pattern to be cached")
+	}
+
+	_, err = compileClientIDPattern("^dev-(1$")
+	if err == nil {
+		t.Errorf("expected an invalid pattern to be rejected")
+	}
+}
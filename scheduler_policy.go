@@ -4,94 +4,19 @@
 // (C) HP Development Company, LP
 package main
 
-import (
-	"fmt"
-
-	"github.com/aws/aws-lambda-go/events"
-)
-
-const (
-	sharedSubscriptionFormat = "$share/krypton/"
-
-	//////////////////// Subscribe topics /////////////////////////////////////
-	//                Topics scheduler needs to subscribe to.
-	// - topic on which devices publish task responses.
-	// arn:aws:iot:AWS_REGION:AWS_ACCOUNT_ID:topicfilter/SHARED_SUBSCRIPTION/v1/@cloud/task_responses
-	// arn:aws:iot:us-west-2:11111122222:topicfilter/$share/krypton/v1/@cloud/task_responses
-	taskResponsesTopicSubscribeFormat = "arn:aws:iot:%s:%s:topicfilter/%sv1/@cloud/task_responses"
-
-	// arn:aws:iot:AWS_REGION:AWS_ACCOUNT_ID:topic/SHARED_SUBSCRIPTION/v1/@cloud/task_responses
-	// arn:aws:iot:us-west-2:11111122222:topic/$share/krypton/v1/@cloud/task_responses
-	taskResponsesTopicReceiveFormat = "arn:aws:iot:%s:%s:topic/%sv1/@cloud/task_responses"
-
-	// - topic on which devices publish messages intended for their management service
-	// arn:aws:iot:AWS_REGION:AWS_ACCOUNT_ID:topicfilter/SHARED_SUBSCRIPTION/v1/@cloud
-	// arn:aws:iot:us-west-2:11111122222:topicfilter/v1/@cloud
-	// arn:aws:iot:us-west-2:11111122222:topicfilter/$share/krypton/v1/@cloud
-	serviceMessageTopicSubscribeFormat = "arn:aws:iot:%s:%s:topicfilter/%sv1/@cloud"
-
-	// arn:aws:iot:AWS_REGION:AWS_ACCOUNT_ID:topic/SHARED_SUBSCRIPTION/v1/@cloud
-	// arn:aws:iot:us-west-2:11111122222:topic/v1/@cloud
-	// arn:aws:iot:us-west-2:11111122222:topic/$share/krypton/v1/@cloud
-	serviceMessageTopicReceiveFormat = "arn:aws:iot:%s:%s:topic/%sv1/@cloud"
-	///////////////////////////////////////////////////////////////////////////
-
-	//////////////////// Publish topics ///////////////////////////////////////
-	//            Topics to which the scheduler publishes messages.
-	// - topic to which the scheduler publishes task responses.
-	// arn:aws:iot:AWS_REGION:AWS_ACCOUNT_ID:topic/v1/*/tasks
-	// arn:aws:iot:us-west-2:11111122222:topic/v1/*/tasks
-	deviceTasksTopic = "arn:aws:iot:%s:%s:topic/v1/*/tasks"
-
-	// - topic to which scheduler publishes broadcast messages from the
-	// corresponding device managment service.
-	// arn:aws:iot:AWS_REGION:AWS_ACCOUNT_ID:topic/v1/@devices/*
-	// arn:aws:iot:us-west-2:11111122222:topic/v1/@devices/*
-	deviceBroadcastMessageTopic = "arn:aws:iot:%s:%s:topic/v1/@devices/*"
-	///////////////////////////////////////////////////////////////////////////
-)
+// selectSchedulerTemplate selects the template of the policy issued to the
+// scheduler. If devices use the v2 topic scheme, the scheduler is
+// additionally granted access to the v2 topics of all tenants. Devices
+// without a management service only publish to the shared cloud topics if
+// explicitly allowed, in which case the scheduler consumes them too.
+func selectSchedulerTemplate(req *policyRequest) (string, error) {
+	template := policyTemplateScheduler + "_" + topicSchemeV2
+	if deviceTopicScheme == topicSchemeV1 {
+		template = policyTemplateScheduler + "_" + topicSchemeV1
+	}
 
-func createIotPolicyDocumentForScheduler(awsRegion string, awsAccount string,
-	clientID string) []*events.IAMPolicyDocument {
-	policyDoc := events.IAMPolicyDocument{
-		Version: "2012-10-17",
-		Statement: []events.IAMPolicyStatement{
-			{
-				Action: connectAction,
-				Effect: "Allow",
-				Resource: []string{fmt.Sprintf(clientResourceFormat, awsRegion,
-					awsAccount, clientID)},
-			},
-			{
-				Action: subscribeAction,
-				Effect: "Allow",
-				Resource: []string{
-					fmt.Sprintf(taskResponsesTopicSubscribeFormat, awsRegion, awsAccount, ""),
-					fmt.Sprintf(taskResponsesTopicSubscribeFormat, awsRegion, awsAccount,
-						sharedSubscriptionFormat),
-					fmt.Sprintf(serviceMessageTopicSubscribeFormat, awsRegion, awsAccount, ""),
-					fmt.Sprintf(serviceMessageTopicSubscribeFormat, awsRegion, awsAccount,
-						sharedSubscriptionFormat)},
-			},
-			{
-				Action: receiveAction,
-				Effect: "Allow",
-				Resource: []string{
-					fmt.Sprintf(taskResponsesTopicReceiveFormat, awsRegion, awsAccount, ""),
-					fmt.Sprintf(taskResponsesTopicReceiveFormat, awsRegion, awsAccount,
-						sharedSubscriptionFormat),
-					fmt.Sprintf(serviceMessageTopicReceiveFormat, awsRegion, awsAccount, ""),
-					fmt.Sprintf(serviceMessageTopicReceiveFormat, awsRegion, awsAccount,
-						sharedSubscriptionFormat)},
-			},
-			{
-				Action: publishAction,
-				Effect: "Allow",
-				Resource: []string{
-					fmt.Sprintf(deviceTasksTopic, awsRegion, awsAccount),
-					fmt.Sprintf(deviceBroadcastMessageTopic, awsRegion, awsAccount)},
-			},
-		},
+	if missingMsClaimBehavior == missingMsClaimLegacyPublish {
+		template += "_" + missingMsClaimLegacyPublish
 	}
-	return []*events.IAMPolicyDocument{&policyDoc}
+	return template, nil
 }
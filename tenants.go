@@ -0,0 +1,35 @@
+// package github.com/HPInc/krypton-iot-authorizer
+// Author: Mahesh Unnikrishnan
+// Component: Krypton AWS IoT Authorizer Lambda
+// (C) HP Development Company, LP
+package main
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// suspendedTenants is the list of IDs of tenants whose devices are blocked
+// from connecting to the broker, eg: because their subscription lapsed or
+// they were offboarded. It is nil if no suspended tenant list is configured.
+var suspendedTenants *refreshableList
+
+// checkTenantSuspension rejects the token if it was issued to a tenant ('tid'
+// claim) that has been suspended.
+func checkTenantSuspension(claims *DstsTokenClaims) error {
+	if suspendedTenants == nil || claims.TenantID == "" {
+		return nil
+	}
+
+	suspended, err := suspendedTenants.contains(claims.TenantID)
+	if err != nil {
+		auditDenied(auditReasonListUnavailable, claims, zap.Error(err))
+		return err
+	}
+	if suspended {
+		auditDenied(auditReasonTenantSuspended, claims)
+		return fmt.Errorf("%w: %s", ErrTenantSuspended, claims.TenantID)
+	}
+	return nil
+}